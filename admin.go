@@ -0,0 +1,323 @@
+package common_http_transform
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// libraryModule is reported with its version by the build info endpoint
+	libraryModule = "github.com/mimiro-io/common-http-transform"
+
+	// defaultLogLevelDuration is how long a log level set through the admin api lasts when no duration is given
+	defaultLogLevelDuration = 15 * time.Minute
+
+	redacted = "[REDACTED]"
+)
+
+// secretKey matches config keys whose values are not returned by the admin api. It errs on the side of
+// redacting: any key mentioning a password, key, auth or cert is hidden, e.g. db_pwd, tls_key_file or basic_auth.
+var secretKey = regexp.MustCompile(`(?i)(token|secret|pass|pwd|credential|key|auth|cert)`)
+
+// adminService serves the admin api. It is a route group on the web service, or its own server when
+// admin_port is set. Every route requires the admin token as a bearer token.
+type adminService struct {
+	e       *echo.Echo
+	port    json.Number
+	token   atomic.Pointer[string]
+	logger  Logger
+	config  *Config
+	updater *configUpdater
+	tls     *tlsServing
+
+	levels     LevelOverrider
+	levelMu    sync.Mutex
+	levelReset *time.Timer
+}
+
+// newAdminService returns nil if admin_enabled is not set
+func newAdminService(config *Config, logger Logger, metrics Metrics, web *transformWebService) (*adminService, error) {
+	conf := config.LayerServiceConfig
+	if !conf.AdminEnabled {
+		return nil, nil
+	}
+	if conf.AdminToken == "" {
+		return nil, errors.New("admin_enabled requires admin_token to be set")
+	}
+
+	a := &adminService{logger: logger.With("component", "admin"), config: config, tls: web.tls}
+	a.levels, _ = logger.(LevelOverrider)
+	a.token.Store(&conf.AdminToken)
+
+	e := web.e
+	if conf.AdminPort != "" {
+		a.port = conf.AdminPort
+		a.e = echo.New()
+		a.e.HideBanner = true
+		a.e.HidePort = true
+		mw(logger, metrics, a.e)
+		e = a.e
+	}
+
+	var middlewares []echo.MiddlewareFunc
+	if a.tls != nil {
+		middlewares = append(middlewares, a.tls.clientCertMiddleware)
+	}
+	g := e.Group("/admin", append(middlewares, middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		KeyLookup:  "header:" + echo.HeaderAuthorization,
+		AuthScheme: "Bearer",
+		Validator:  a.validToken,
+		ErrorHandler: func(err error, c echo.Context) error {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return echo.NewHTTPError(http.StatusUnauthorized, "missing or invalid admin token")
+		},
+	}))...)
+	g.GET("/config", a.getConfig)
+	g.GET("/config/reloads", a.getReloads)
+	g.POST("/config/reload", a.reloadConfig)
+	g.PUT("/log-level", a.setLogLevel)
+	g.GET("/build", a.getBuild)
+	return a, nil
+}
+
+func (a *adminService) validToken(key string, _ echo.Context) (bool, error) {
+	token := *a.token.Load()
+	return token != "" && subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1, nil
+}
+
+// Start starts the admin server if the admin api has its own port
+func (a *adminService) Start() error {
+	if a.e == nil {
+		return nil
+	}
+	a.logger.Info(fmt.Sprintf("Starting admin server on :%s", a.port))
+	listener, err := net.Listen("tcp", ":"+a.port.String())
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrListen, err)
+	}
+	if a.tls != nil {
+		listener = tls.NewListener(listener, a.tls.serverConfig())
+	}
+	a.e.Listener = listener
+
+	go func() {
+		err := a.e.Start("")
+		if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			a.logger.Error("Admin server failed", "error", err.Error())
+		}
+	}()
+	return nil
+}
+
+func (a *adminService) Stop(ctx context.Context) error {
+	a.levelMu.Lock()
+	if a.levelReset != nil {
+		a.levelReset.Stop()
+	}
+	a.levelMu.Unlock()
+
+	if a.e == nil {
+		return nil
+	}
+	err := a.e.Shutdown(ctx)
+	if a.e.Listener != nil {
+		_ = a.e.Listener.Close()
+	}
+	return err
+}
+
+func (a *adminService) ValidateConfiguration(config *Config) error {
+	if config.LayerServiceConfig.AdminEnabled && config.LayerServiceConfig.AdminToken == "" {
+		return errors.New("admin_enabled requires admin_token to be set")
+	}
+	return nil
+}
+
+// UpdateConfiguration rotates the admin token. Disabling the admin api locks it until the service is restarted.
+func (a *adminService) UpdateConfiguration(config *Config) TransformError {
+	token := config.LayerServiceConfig.AdminToken
+	if !config.LayerServiceConfig.AdminEnabled {
+		token = ""
+	}
+	a.token.Store(&token)
+	return nil
+}
+
+func (a *adminService) currentConfig() *Config {
+	if a.updater != nil {
+		return a.updater.currentConfig()
+	}
+	return a.config
+}
+
+func (a *adminService) getConfig(c echo.Context) error {
+	values, err := redactConfig(a.currentConfig())
+	if err != nil {
+		return Err(err, LayerErrorInternal).toHTTPError()
+	}
+	return c.JSON(http.StatusOK, values)
+}
+
+type configReloads struct {
+	Reloads   []configReloadEvent `json:"reloads"`
+	LastError *configReloadEvent  `json:"last_error,omitempty"`
+}
+
+func (a *adminService) getReloads(c echo.Context) error {
+	result := configReloads{Reloads: []configReloadEvent{}}
+	if a.updater != nil {
+		result.Reloads = a.updater.reloadHistory()
+	}
+	for i := len(result.Reloads) - 1; i >= 0; i-- {
+		if result.Reloads[i].Error != "" {
+			result.LastError = &result.Reloads[i]
+			break
+		}
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func (a *adminService) reloadConfig(c echo.Context) error {
+	if a.updater == nil || a.updater.forceReload == nil {
+		return Errorf(LayerErrorUpstreamUnavailable, "config updater is not running").toHTTPError()
+	}
+	a.logger.Info("Config reload requested through admin api")
+	return c.JSON(http.StatusOK, a.updater.forceReload())
+}
+
+type logLevelRequest struct {
+	Level    string `json:"level"`
+	Duration string `json:"duration"`
+}
+
+type logLevelResponse struct {
+	Level string    `json:"level"`
+	Until time.Time `json:"until"`
+}
+
+// setLogLevel changes the log level for a limited time, after which the configured log_level applies again.
+// The level is overridden in the logger of the service, so that a config reload in the meantime keeps it.
+func (a *adminService) setLogLevel(c echo.Context) error {
+	if a.levels == nil {
+		return echo.NewHTTPError(http.StatusNotImplemented, "the logger of the service does not support changing the log level")
+	}
+	req := &logLevelRequest{}
+	if err := c.Bind(req); err != nil {
+		return Errorf(LayerErrorBadParameter, "invalid log level request: %v", err).toHTTPError()
+	}
+	var level zerolog.Level
+	switch strings.ToLower(req.Level) {
+	case "debug", "info", "warn", "error":
+		level = logLevel(req.Level)
+	default:
+		return Errorf(LayerErrorBadParameter, "invalid log level %q, expected one of debug, info, warn, error", req.Level).toHTTPError()
+	}
+	duration := defaultLogLevelDuration
+	if req.Duration != "" {
+		d, err := asDuration(req.Duration)
+		if err != nil {
+			return Err(err, LayerErrorBadParameter).toHTTPError()
+		}
+		duration = d
+	}
+
+	a.levelMu.Lock()
+	defer a.levelMu.Unlock()
+	if a.levelReset != nil {
+		a.levelReset.Stop()
+	}
+	a.levels.OverrideLevel(level.String())
+	var reset *time.Timer
+	reset = time.AfterFunc(duration, func() {
+		a.levelMu.Lock()
+		defer a.levelMu.Unlock()
+		if a.levelReset != reset {
+			// replaced by a later request
+			return
+		}
+		a.levelReset = nil
+		a.levels.ClearLevelOverride()
+		configured := a.currentConfig().LayerServiceConfig.LogLevel
+		a.logger.Info("Temporary log level expired", "level", logLevel(configured).String())
+	})
+	a.levelReset = reset
+	a.logger.Info("Log level changed through admin api", "level", level.String(), "duration", duration.String())
+
+	return c.JSON(http.StatusOK, logLevelResponse{Level: level.String(), Until: time.Now().Add(duration)})
+}
+
+type buildInfo struct {
+	ServiceName    string `json:"service_name"`
+	Module         string `json:"module,omitempty"`
+	ModuleVersion  string `json:"module_version,omitempty"`
+	LibraryVersion string `json:"library_version,omitempty"`
+	GoVersion      string `json:"go_version"`
+}
+
+func (a *adminService) getBuild(c echo.Context) error {
+	result := buildInfo{
+		ServiceName: a.currentConfig().LayerServiceConfig.ServiceName,
+		GoVersion:   runtime.Version(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		result.Module = info.Main.Path
+		result.ModuleVersion = info.Main.Version
+		for _, dep := range info.Deps {
+			if dep.Path == libraryModule {
+				result.LibraryVersion = dep.Version
+			}
+		}
+		if info.Main.Path == libraryModule {
+			result.LibraryVersion = info.Main.Version
+		}
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// redactConfig returns the config as generic values, with the values of keys that look like secrets replaced
+func redactConfig(config *Config) (map[string]any, error) {
+	content, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]any
+	if err = json.Unmarshal(content, &values); err != nil {
+		return nil, err
+	}
+	redact(values)
+	return values, nil
+}
+
+func redact(value any) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, nested := range v {
+			if secretKey.MatchString(key) && nested != nil && nested != "" {
+				v[key] = redacted
+				continue
+			}
+			redact(nested)
+		}
+	case []any:
+		for _, nested := range v {
+			redact(nested)
+		}
+	}
+}
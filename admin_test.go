@@ -0,0 +1,200 @@
+package common_http_transform
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+)
+
+const testAdminConfig = `{"layer_config": {"service_name": "test", "log_level": "error", "admin_enabled": true, "admin_token": "s3cret", "config_reload_mode": "poll", "config_refresh_interval": "1h"}, "external_config": {"db_password": "hunter2", "host": "db"}}`
+
+func newTestAdminService(t *testing.T) (*transformWebService, *adminService) {
+	t.Helper()
+	configFile := writeTestConfig(t, testAdminConfig)
+	config, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := newTestWebServiceWithConfig(t, testAdminConfig, &testTransform{})
+	a, err := newAdminService(config, ws.logger, ws.metrics, ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.updater, err = newConfigUpdater(config, nil, ws.logger, nil, ws, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = a.updater.Stop(context.Background())
+		_ = a.Stop(context.Background())
+	})
+	return ws, a
+}
+
+func adminRequest(ws *transformWebService, method string, path string, body string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	ws.e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	ws, _ := newTestAdminService(t)
+
+	for _, token := range []string{"", "wrong"} {
+		rec := adminRequest(ws, http.MethodGet, "/admin/build", "", token)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected token %q to be rejected with 401, got %d", token, rec.Code)
+		}
+		if rec.Header().Get(echo.HeaderWWWAuthenticate) != "Bearer" {
+			t.Errorf("expected a bearer challenge for token %q, got %q", token, rec.Header().Get(echo.HeaderWWWAuthenticate))
+		}
+	}
+	if rec := adminRequest(ws, http.MethodGet, "/admin/build", "", "s3cret"); rec.Code != http.StatusOK {
+		t.Errorf("expected build info with valid token, got %d", rec.Code)
+	}
+
+	_, err := newAdminService(&Config{LayerServiceConfig: &LayerServiceConfig{AdminEnabled: true}}, ws.logger, ws.metrics, ws)
+	if err == nil {
+		t.Error("expected admin api without token to be rejected")
+	}
+}
+
+func TestAdminConfigIsRedacted(t *testing.T) {
+	ws, _ := newTestAdminService(t)
+
+	rec := adminRequest(ws, http.MethodGet, "/admin/config", "", "s3cret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	if strings.Contains(body, "s3cret") || strings.Contains(body, "hunter2") {
+		t.Errorf("expected secrets to be redacted, got %s", body)
+	}
+	if !strings.Contains(body, `"host":"db"`) {
+		t.Errorf("expected other values to be returned, got %s", body)
+	}
+}
+
+func TestAdminRedactsSampleConfig(t *testing.T) {
+	t.Setenv("DB_NAME", "products")
+	t.Setenv("DB_USER", "svc")
+	t.Setenv("DB_PWD", "hunter2")
+	config, err := loadConfig("./sample/config/sample_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the env overrides of the sample's EnrichConfig
+	err = BuildNativeSystemEnvOverrides(Env("db_name", true), Env("db_user", true, "dbUser"), Env("db_pwd", true))(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := redactConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	external := values["external_config"].(map[string]any)
+	if external["db_pwd"] != redacted {
+		t.Errorf("expected db_pwd to be redacted, got %v", external["db_pwd"])
+	}
+	if external["db_name"] != "products" || external["dbUser"] != "svc" {
+		t.Errorf("expected other values to be returned, got %v", external)
+	}
+	for _, key := range []string{"api_key", "db_pass", "basic_auth", "tls_cert"} {
+		if !secretKey.MatchString(key) {
+			t.Errorf("expected %s to be redacted", key)
+		}
+	}
+}
+
+func TestAdminForceReload(t *testing.T) {
+	ws, _ := newTestAdminService(t)
+
+	rec := adminRequest(ws, http.MethodPost, "/admin/config/reload", "", "s3cret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	event := &configReloadEvent{}
+	if err := json.Unmarshal(rec.Body.Bytes(), event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Outcome != configReloadApplied || !event.Forced {
+		t.Errorf("expected forced reload to be applied, got %+v", event)
+	}
+
+	rec = adminRequest(ws, http.MethodGet, "/admin/config/reloads", "", "s3cret")
+	reloads := &configReloads{}
+	if err := json.Unmarshal(rec.Body.Bytes(), reloads); err != nil {
+		t.Fatal(err)
+	}
+	if len(reloads.Reloads) != 1 || reloads.LastError != nil {
+		t.Errorf("expected one successful reload in history, got %+v", reloads)
+	}
+}
+
+func TestAdminSetLogLevel(t *testing.T) {
+	ws, _ := newTestAdminService(t)
+	defer zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	rec := adminRequest(ws, http.MethodPut, "/admin/log-level", `{"level": "verbose"}`, "s3cret")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected unknown level to be rejected, got %d", rec.Code)
+	}
+
+	rec = adminRequest(ws, http.MethodPut, "/admin/log-level", `{"level": "debug", "duration": "1s"}`, "s3cret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if zerolog.GlobalLevel() != zerolog.DebugLevel {
+		t.Errorf("expected debug level, got %s", zerolog.GlobalLevel())
+	}
+
+	// a config reload keeps the override, until it expires
+	config, _ := readConfig(strings.NewReader(`{"layer_config": {"log_level": "warn"}}`))
+	if err := ws.logger.(*logger).UpdateConfiguration(config); err != nil {
+		t.Fatal(err)
+	}
+	if zerolog.GlobalLevel() != zerolog.DebugLevel {
+		t.Errorf("expected the override to survive a config reload, got %s", zerolog.GlobalLevel())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for zerolog.GlobalLevel() != zerolog.WarnLevel && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if zerolog.GlobalLevel() != zerolog.WarnLevel {
+		t.Errorf("expected the configured level once the override expired, got %s", zerolog.GlobalLevel())
+	}
+}
+
+// plainLogger is a Logger given with WithLogger that does not implement LevelOverrider
+type plainLogger struct {
+	Logger
+}
+
+func TestAdminSetLogLevelUnsupportedLogger(t *testing.T) {
+	config, err := readConfig(strings.NewReader(testAdminConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := newTestWebServiceWithConfig(t, testAdminConfig, &testTransform{})
+	if _, err = newAdminService(config, plainLogger{ws.logger}, ws.metrics, ws); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := adminRequest(ws, http.MethodPut, "/admin/log-level", `{"level": "debug"}`, "s3cret")
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("expected status 501 for a logger without level override, got %d", rec.Code)
+	}
+}
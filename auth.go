@@ -0,0 +1,353 @@
+package common_http_transform
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultJWKSRefreshInterval = time.Hour
+
+	// jwksMinRefetchInterval limits how often a token signed with an unknown key triggers a refetch of the key set
+	jwksMinRefetchInterval = time.Minute
+)
+
+// jwtAlgorithms are the signing algorithms that can be verified with keys from a JWKS
+var jwtAlgorithms = map[string]bool{
+	"RS256": true, "RS384": true, "RS512": true,
+	"PS256": true, "PS384": true, "PS512": true,
+	"ES256": true, "ES384": true, "ES512": true,
+	"EdDSA": true,
+}
+
+type claimsKey struct{}
+
+// ClaimsFromContext returns the claims of the bearer token the request was authenticated with. It returns
+// false if jwt_enabled is not set.
+func ClaimsFromContext(ctx context.Context) (map[string]any, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(jwt.MapClaims)
+	return claims, ok
+}
+
+// jwtAuth validates the bearer token of requests against the keys of a JWKS
+type jwtAuth struct {
+	parser *jwt.Parser
+	keys   *jwks
+	logger Logger
+}
+
+// newJWTAuth returns nil if jwt_enabled is not set
+func newJWTAuth(conf *LayerServiceConfig, logger Logger) (*jwtAuth, error) {
+	if !conf.JWTEnabled {
+		return nil, nil
+	}
+	if (conf.JWKSURL == "") == (conf.JWKSFile == "") {
+		return nil, errors.New("jwt_enabled requires one of jwt_jwks_url or jwt_jwks_file to be set")
+	}
+
+	algorithms := conf.JWTAlgorithms
+	if len(algorithms) == 0 {
+		algorithms = []string{"RS256"}
+	}
+	for _, alg := range algorithms {
+		if !jwtAlgorithms[alg] {
+			return nil, fmt.Errorf("unsupported jwt algorithm %s", alg)
+		}
+	}
+	options := []jwt.ParserOption{jwt.WithValidMethods(algorithms), jwt.WithExpirationRequired()}
+	if conf.JWTIssuer != "" {
+		options = append(options, jwt.WithIssuer(conf.JWTIssuer))
+	}
+	if conf.JWTAudience != "" {
+		options = append(options, jwt.WithAudience(conf.JWTAudience))
+	}
+
+	refreshInterval := defaultJWKSRefreshInterval
+	if conf.JWKSRefreshInterval != "" {
+		var err error
+		refreshInterval, err = asDuration(conf.JWKSRefreshInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwt_jwks_refresh_interval: %w", err)
+		}
+	}
+
+	keys := &jwks{url: conf.JWKSURL, file: conf.JWKSFile, client: &http.Client{Timeout: 10 * time.Second}, logger: logger}
+	if err := keys.load(); err != nil {
+		return nil, fmt.Errorf("failed to load jwks: %w", err)
+	}
+	keys.startRefreshing(refreshInterval)
+
+	return &jwtAuth{parser: jwt.NewParser(options...), keys: keys, logger: logger}, nil
+}
+
+// middleware rejects requests without a valid bearer token with 401, and tokens for another issuer or
+// audience with 403. The claims of valid tokens are added to the request context.
+func (a *jwtAuth) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header := c.Request().Header.Get(echo.HeaderAuthorization)
+		scheme, tokenString, found := strings.Cut(header, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") || tokenString == "" {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer`)
+			return Errorf(LayerErrorUnauthorized, "missing bearer token").toHTTPError()
+		}
+
+		claims := jwt.MapClaims{}
+		_, err := a.parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+			kid, _ := token.Header["kid"].(string)
+			return a.keys.key(kid)
+		})
+		if err != nil {
+			a.logger.Debug("Rejected bearer token", "error", err.Error())
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			if errors.Is(err, jwt.ErrTokenInvalidIssuer) || errors.Is(err, jwt.ErrTokenInvalidAudience) {
+				return Errorf(LayerErrorForbidden, "token is not valid for this service").toHTTPError()
+			}
+			return Errorf(LayerErrorUnauthorized, "invalid bearer token").toHTTPError()
+		}
+
+		ctx := context.WithValue(c.Request().Context(), claimsKey{}, claims)
+		c.SetRequest(c.Request().WithContext(ctx))
+		return next(c)
+	}
+}
+
+func (a *jwtAuth) Stop(_ context.Context) error {
+	a.keys.stop()
+	return nil
+}
+
+// jwks holds the public keys of a JWKS read from a file or url. The keys are reloaded every refresh
+// interval, and when a token refers to a key that is not known yet, so that rotated keys are picked up.
+type jwks struct {
+	url    string
+	file   string
+	client *http.Client
+	logger Logger
+
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey
+	lastFetch time.Time
+
+	// refetchMu allows one refetch for an unknown key at a time. lastAttempt is when it last started,
+	// whether or not it succeeded, so that a failing key set url is not hammered.
+	refetchMu   sync.Mutex
+	lastAttempt time.Time
+
+	ticker   *time.Ticker
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func (k *jwks) load() error {
+	var data []byte
+	var err error
+	if k.file != "" {
+		data, err = os.ReadFile(k.file)
+	} else {
+		data, err = k.fetch()
+	}
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	k.lastFetch = time.Now()
+	return nil
+}
+
+func (k *jwks) fetch() ([]byte, error) {
+	resp, err := k.client.Get(k.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, k.url)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (k *jwks) startRefreshing(interval time.Duration) {
+	k.ticker = time.NewTicker(interval)
+	k.done = make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-k.done:
+				return
+			case <-k.ticker.C:
+				if err := k.load(); err != nil {
+					k.logger.Warn("Failed to refresh jwks, keeping current keys", "error", err.Error())
+				}
+			}
+		}
+	}()
+}
+
+func (k *jwks) stop() {
+	k.stopOnce.Do(func() {
+		if k.ticker != nil {
+			k.ticker.Stop()
+			close(k.done)
+		}
+	})
+}
+
+// key returns the key with the given id. A token without key id can be used when the set has a single key.
+func (k *jwks) key(kid string) (crypto.PublicKey, error) {
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+
+	k.refetchMu.Lock()
+	defer k.refetchMu.Unlock()
+	// the key may have been fetched by another request while this one waited
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+	k.mu.RLock()
+	refetch := time.Since(k.lastFetch) >= jwksMinRefetchInterval && time.Since(k.lastAttempt) >= jwksMinRefetchInterval
+	k.mu.RUnlock()
+	if refetch {
+		k.lastAttempt = time.Now()
+		if err := k.load(); err != nil {
+			k.logger.Warn("Failed to refresh jwks", "error", err.Error())
+		} else if key, ok := k.lookup(kid); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (k *jwks) lookup(kid string) (crypto.PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS reads the RSA, EC and Ed25519 signing keys of a key set. Other keys are skipped.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid jwks: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in jwks: %w", jwk.Kid, err)
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks contains no signing keys")
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, nil
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
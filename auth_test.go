@@ -0,0 +1,166 @@
+package common_http_transform
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+type claimsTransform struct {
+	testTransform
+	claims map[string]any
+}
+
+func (ct *claimsTransform) Transform(ctx context.Context, ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	ct.claims, _ = ClaimsFromContext(ctx)
+	return ec, nil
+}
+
+func testJWKS(t *testing.T, kid string, key *rsa.PrivateKey) string {
+	t.Helper()
+	n := base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+	e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	return fmt.Sprintf(`{"keys": [{"kty": "RSA", "kid": %q, "use": "sig", "alg": "RS256", "n": %q, "e": %q}]}`, kid, n, e)
+}
+
+func signTestToken(t *testing.T, kid string, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestJWTAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err = os.WriteFile(jwksFile, []byte(testJWKS(t, "key-1", key)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	transform := &claimsTransform{}
+	conf := fmt.Sprintf(`{"layer_config": {"log_level": "error", "jwt_enabled": true, "jwt_issuer": "https://hub.example.com", "jwt_audience": "transform", "jwt_jwks_file": %q}}`, jwksFile)
+	ws := newTestWebServiceWithConfig(t, conf, ContextTransform(transform))
+	t.Cleanup(func() { _ = ws.auth.Stop(context.Background()) })
+
+	valid := jwt.MapClaims{"iss": "https://hub.example.com", "aud": "transform", "sub": "datahub", "exp": time.Now().Add(time.Hour).Unix()}
+	wrongAudience := jwt.MapClaims{"iss": "https://hub.example.com", "aud": "other", "exp": time.Now().Add(time.Hour).Unix()}
+	expired := jwt.MapClaims{"iss": "https://hub.example.com", "aud": "transform", "exp": time.Now().Add(-time.Hour).Unix()}
+
+	cases := map[string]struct {
+		authorization string
+		status        int
+	}{
+		"missing token":  {"", http.StatusUnauthorized},
+		"not bearer":     {"Basic dXNlcjpwYXNz", http.StatusUnauthorized},
+		"wrong key":      {"Bearer " + signTestToken(t, "key-1", otherKey, valid), http.StatusUnauthorized},
+		"expired":        {"Bearer " + signTestToken(t, "key-1", key, expired), http.StatusUnauthorized},
+		"wrong audience": {"Bearer " + signTestToken(t, "key-1", key, wrongAudience), http.StatusForbidden},
+		"valid":          {"Bearer " + signTestToken(t, "key-1", key, valid), http.StatusOK},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tc.authorization != "" {
+				headers["Authorization"] = tc.authorization
+			}
+			rec := postTransform(ws, testEntities, headers)
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d, got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	if transform.claims["sub"] != "datahub" {
+		t.Errorf("expected claims of valid token in context, got %v", transform.claims)
+	}
+}
+
+func TestJWKSRefetchesUnknownKey(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+	current := testJWKS(t, "key-1", key)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(current))
+	}))
+	defer server.Close()
+
+	keys := &jwks{url: server.URL, client: server.Client(), logger: NewLogger("test", "json", "error")}
+	if err := keys.load(); err != nil {
+		t.Fatal(err)
+	}
+	current = testJWKS(t, "key-2", rotated)
+
+	if _, err := keys.key("key-2"); err == nil {
+		t.Error("expected unknown key not to be refetched within the minimum refetch interval")
+	}
+	keys.lastFetch = time.Now().Add(-jwksMinRefetchInterval)
+	if _, err := keys.key("key-2"); err != nil {
+		t.Errorf("expected rotated key to be fetched, got %v", err)
+	}
+}
+
+func TestJWKSRefetchIsLimitedWhenFetchFails(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var requests atomic.Int32
+	var failing atomic.Bool
+	jwksContent := testJWKS(t, "key-1", key)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		if failing.Load() {
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(jwksContent))
+	}))
+	defer server.Close()
+
+	keys := &jwks{url: server.URL, client: server.Client(), logger: NewLogger("test", "json", "error")}
+	if err := keys.load(); err != nil {
+		t.Fatal(err)
+	}
+	failing.Store(true)
+	requests.Store(0)
+	keys.lastFetch = time.Now().Add(-jwksMinRefetchInterval)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = keys.key("key-2")
+		}()
+	}
+	wg.Wait()
+	if _, err := keys.key("key-2"); err == nil {
+		t.Error("expected the unknown key to be rejected")
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected a single refetch for concurrent and repeated unknown keys, got %d", n)
+	}
+}
@@ -0,0 +1,206 @@
+package common_http_transform
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+const cliUsage = `Usage: %s [command] [flags]
+       %s <config file>
+
+Commands:
+  serve            start the http service and wait for SIGINT or SIGTERM (the default)
+  transform        transform the entities in a file, or stdin, without starting the http service
+  validate-config  load the config and set the service up without starting it
+
+Run '%s <command> -h' for the flags of a command.
+`
+
+// RunCLI is the main function of a transform service. See ServiceRunner.RunCLI.
+func RunCLI(newTransformService func(config *Config, logger Logger, metrics Metrics) (TransformService, error)) {
+	NewServiceRunner(newTransformService).RunCLI()
+}
+
+// RunCLI runs the command given on the command line and exits. The commands load the config the same
+// way, from --config, DATALAYER_CONFIG_PATH or ./config, and enrich it with WithEnrichConfig:
+//
+//	serve                                 start the service and wait, like StartAndWait
+//	transform [--in file] [--out file]    call Transform with the entities in file (default stdin) and
+//	          [--name transform]          write the result to file (default stdout), using the transform
+//	                                      registered with WithTransform under the name if given
+//	validate-config                       check that the service can be set up with the config
+//
+// A first argument that is not a command is taken as the config file of serve, so that services started
+// with the config location as their only argument keep working.
+func (serviceRunner *ServiceRunner) RunCLI() {
+	os.Exit(serviceRunner.runCLI(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// runCLI runs a command and returns the exit code: 0 on success, 1 if the command failed and 2 for
+// invalid arguments
+func (serviceRunner *ServiceRunner) runCLI(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	program := "transform-service"
+	if len(os.Args) > 0 {
+		program = filepath.Base(os.Args[0])
+	}
+	command := "serve"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		if isCommand(args[0]) {
+			command, args = args[0], args[1:]
+		} else {
+			args = append([]string{"--config"}, args...)
+		}
+	}
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configLocation := flags.String("config", serviceRunner.configLocation, "config file, defaults to DATALAYER_CONFIG_PATH or ./config")
+	var in, out, name *string
+	switch command {
+	case "serve", "validate-config":
+	case "transform":
+		in = flags.String("in", "", "file with the entities to transform, defaults to stdin")
+		out = flags.String("out", "", "file to write the transformed entities to, defaults to stdout")
+		name = flags.String("name", "", "transform registered with WithTransform to run, defaults to the service on /transform")
+	case "help":
+		fmt.Fprintf(stdout, cliUsage, program, program, program)
+		return 0
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(stderr, "unexpected arguments %v\n", flags.Args())
+		return 2
+	}
+	serviceRunner.configLocation = *configLocation
+
+	var err error
+	switch command {
+	case "serve":
+		if err = serviceRunner.Start(); err == nil {
+			serviceRunner.andWait()
+		}
+	case "transform":
+		// stdout may carry the entities, so the service logs to stderr
+		serviceRunner.logOutput = stderr
+		err = serviceRunner.transformFile(*name, *in, *out, stdin, stdout)
+	case "validate-config":
+		serviceRunner.logOutput = stderr
+		if err = serviceRunner.validateConfig(); err == nil {
+			fmt.Fprintf(stdout, "config %s is valid\n", serviceRunner.configLocation)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", command, err.Error())
+		return 1
+	}
+	return 0
+}
+
+func isCommand(arg string) bool {
+	switch arg {
+	case "serve", "transform", "validate-config", "help":
+		return true
+	}
+	return false
+}
+
+// transformFile parses the entities in inFile, or stdin if not given, runs the service with the name, or
+// the default service if name is empty, with TransformEntities and writes the result to outFile, or stdout
+// if not given. The context given to the service is cancelled on SIGINT or SIGTERM.
+func (serviceRunner *ServiceRunner) transformFile(name string, inFile string, outFile string, stdin io.Reader, stdout io.Writer) error {
+	config, err := serviceRunner.prepareConfig()
+	if err != nil {
+		return err
+	}
+	createService, logger, metrics := serviceRunner.createService, serviceRunner.logger, serviceRunner.metrics
+	if name != "" {
+		named := serviceRunner.namedTransform(name)
+		if named == nil {
+			return fmt.Errorf("unknown transform %q", name)
+		}
+		createService, logger, metrics = named.createService, logger.With("transform", name), withTags(metrics, "transform:"+name)
+	}
+	serviceRunner.transformService, err = createService(config, logger, metrics)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrServiceFactory, err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), serviceRunner.shutdownTimeout)
+		defer cancel()
+		_ = serviceRunner.transformService.Stop(ctx)
+	}()
+
+	in := stdin
+	if inFile != "" {
+		file, err := os.Open(inFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	nsManager := egdm.NewNamespaceContext()
+	parser := egdm.NewEntityParser(nsManager)
+	parser.WithExpandURIs()
+	ec := egdm.NewEntityCollection(nsManager)
+	if err = parser.Parse(in, ec.AddEntity, ec.SetContinuationToken); err != nil {
+		return fmt.Errorf("could not parse the entities: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	transformed, transformErr := TransformEntities(ctx, serviceRunner.transformService, ec)
+	if transformErr != nil {
+		return transformErr
+	}
+	if transformed == nil {
+		return errors.New("transform returned no entity collection")
+	}
+
+	out := stdout
+	if outFile != "" {
+		file, err := os.Create(outFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	return transformed.WriteEntityGraphJSON(out)
+}
+
+// validateConfig sets the service up the way Start does, without listening, and passes the config to
+// the ValidateConfiguration of every transform service that implements ConfigValidator
+func (serviceRunner *ServiceRunner) validateConfig() error {
+	defer func() { _ = serviceRunner.Stop() }()
+	if err := serviceRunner.configure(); err != nil {
+		return err
+	}
+	services := []TransformService{serviceRunner.transformService}
+	for _, named := range serviceRunner.namedTransforms {
+		services = append(services, named.service)
+	}
+	for _, service := range services {
+		if validator, ok := service.(ConfigValidator); ok {
+			if err := validator.ValidateConfiguration(serviceRunner.configUpdater.currentConfig()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
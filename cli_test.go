@@ -0,0 +1,106 @@
+package common_http_transform
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func newCLITestRunner() *ServiceRunner {
+	return NewServiceRunner(func(_ *Config, _ Logger, _ Metrics) (TransformService, error) {
+		return &testTransform{transform: func(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+			result := egdm.NewEntityCollection(ec.NamespaceManager)
+			for _, entity := range ec.Entities {
+				entity.Properties["http://example.com/seen"] = true
+				_ = result.AddEntity(entity)
+			}
+			return result, nil
+		}}, nil
+	})
+}
+
+func TestRunCLITransform(t *testing.T) {
+	configFile := writeTestConfig(t, `{"layer_config": {"service_name": "test", "log_level": "error"}}`)
+
+	var stdout, stderr bytes.Buffer
+	code := newCLITestRunner().runCLI([]string{"transform", "--config", configFile}, strings.NewReader(testEntities), &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), `"http://example.com/seen":true`) {
+		t.Errorf("expected transformed entities on stdout, got %s", stdout.String())
+	}
+
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in.json"), filepath.Join(dir, "out.json")
+	if err := os.WriteFile(in, []byte(testEntities), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Reset()
+	code = newCLITestRunner().runCLI([]string{"transform", "--config", configFile, "--in", in, "--out", out}, nil, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	content, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(content), `"http://example.com/seen":true`) != 2 || stdout.Len() != 0 {
+		t.Errorf("expected both transformed entities in the out file only, got %s", content)
+	}
+
+	stderr.Reset()
+	code = newCLITestRunner().runCLI([]string{"transform", "--config", configFile}, strings.NewReader("not json"), &stdout, &stderr)
+	if code != 1 || !strings.Contains(stderr.String(), "could not parse the entities") {
+		t.Errorf("expected exit code 1 with a parse error, got %d: %s", code, stderr.String())
+	}
+}
+
+func TestRunCLITransformPrefersStreamingService(t *testing.T) {
+	configFile := writeTestConfig(t, `{"layer_config": {"service_name": "test", "log_level": "error"}}`)
+	runner := NewServiceRunner(func(_ *Config, _ Logger, _ Metrics) (TransformService, error) {
+		return &testStreamingTransform{testTransform: testTransform{transform: func(_ *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+			return nil, Errorf(LayerErrorInternal, "Transform must not be called on a streaming service")
+		}}}, nil
+	})
+
+	var stdout, stderr bytes.Buffer
+	code := runner.runCLI([]string{"transform", "--config", configFile}, strings.NewReader(testEntities), &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if strings.Count(stdout.String(), `"id":"ex:2"`)+strings.Count(stdout.String(), `"id":"http://example.com/2"`) != 2 {
+		t.Errorf("expected the second entity to be emitted twice by StreamEntity, got %s", stdout.String())
+	}
+}
+
+func TestRunCLIValidateConfig(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	configFile := writeTestConfig(t, `{"layer_config": {"service_name": "test", "log_level": "error"}}`)
+	code := newCLITestRunner().runCLI([]string{"validate-config", "--config", configFile}, nil, &stdout, &stderr)
+	if code != 0 || !strings.Contains(stdout.String(), "is valid") {
+		t.Errorf("expected a valid config, got %d: %s", code, stderr.String())
+	}
+
+	configFile = writeTestConfig(t, `{"layer_config": {"service_name": "test", "log_level": "error", "transform_timeout": "soon"}}`)
+	code = newCLITestRunner().runCLI([]string{"validate-config", "--config", configFile}, nil, &stdout, &stderr)
+	if code != 1 || !strings.Contains(stderr.String(), "transform_timeout") {
+		t.Errorf("expected an invalid config, got %d: %s", code, stderr.String())
+	}
+}
+
+func TestRunCLIUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	// a first argument that is not a command is the config file of serve
+	code := newCLITestRunner().runCLI([]string{"./testdata/missing.json"}, nil, &stdout, &stderr)
+	if code != 1 || !strings.Contains(stderr.String(), "serve: ") || !strings.Contains(stderr.String(), "missing.json") {
+		t.Errorf("expected serve to fail loading the config given as argument, got %d: %s", code, stderr.String())
+	}
+	if code := newCLITestRunner().runCLI([]string{"transform", "--unknown"}, nil, &stdout, &stderr); code != 2 {
+		t.Errorf("expected exit code 2 for an unknown flag, got %d", code)
+	}
+}
@@ -0,0 +1,250 @@
+package common_http_transform
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	encodingGzip = "gzip"
+	encodingZstd = "zstd"
+
+	// defaultCompressionMinBytes is used when compression_min_bytes is not set
+	defaultCompressionMinBytes = 1024
+)
+
+// decodeRequestBody replaces a gzip or zstd encoded request body with the decoded body
+func decodeRequestBody(c echo.Context) TransformError {
+	req := c.Request()
+	encoding := strings.ToLower(strings.TrimSpace(req.Header.Get(echo.HeaderContentEncoding)))
+	var decoded io.ReadCloser
+	switch encoding {
+	case "", "identity":
+		return nil
+	case encodingGzip:
+		reader, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return Errorf(LayerErrorBadParameter, "invalid gzip request body: %s", err.Error())
+		}
+		decoded = &decodedBody{Reader: reader, closers: []io.Closer{reader, req.Body}}
+	case encodingZstd:
+		reader, err := zstd.NewReader(req.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return Errorf(LayerErrorBadParameter, "invalid zstd request body: %s", err.Error())
+		}
+		decoded = &decodedBody{Reader: reader, closers: []io.Closer{zstdDecoderCloser{reader}, req.Body}}
+	default:
+		return Errorf(LayerErrorBadParameter, "unsupported content encoding %s, expected one of gzip, zstd", encoding)
+	}
+	req.Body = decoded
+	req.Header.Del(echo.HeaderContentEncoding)
+	// the decoded length is not known up front
+	req.ContentLength = -1
+	return nil
+}
+
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	var err error
+	for _, closer := range b.closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+type zstdDecoderCloser struct {
+	decoder *zstd.Decoder
+}
+
+func (z zstdDecoderCloser) Close() error {
+	z.decoder.Close()
+	return nil
+}
+
+// negotiateEncoding picks the response encoding from the Accept-Encoding header, preferring zstd over
+// gzip when the client accepts both equally. It returns an empty string for an uncompressed response.
+func negotiateEncoding(acceptEncoding string) string {
+	type candidate struct {
+		encoding string
+		q        float64
+		rank     int
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch name {
+		case encodingZstd:
+			candidates = append(candidates, candidate{name, q, 0})
+		case encodingGzip:
+			candidates = append(candidates, candidate{name, q, 1})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].q != candidates[j].q {
+			return candidates[i].q > candidates[j].q
+		}
+		return candidates[i].rank < candidates[j].rank
+	})
+	if len(candidates) == 0 || candidates[0].q <= 0 {
+		return ""
+	}
+	return candidates[0].encoding
+}
+
+// compressingWriter compresses the response once it reaches minBytes. Until then the status and
+// body are held back, so that small responses are sent uncompressed with their original headers.
+type compressingWriter struct {
+	http.ResponseWriter
+	encoding   string
+	minBytes   int
+	status     int
+	buffer     bytes.Buffer
+	decided    bool
+	compressor io.WriteCloser
+}
+
+func newCompressingWriter(w http.ResponseWriter, encoding string, minBytes int) *compressingWriter {
+	return &compressingWriter{ResponseWriter: w, encoding: encoding, minBytes: minBytes}
+}
+
+func (w *compressingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.decided {
+		if w.compressor != nil {
+			return w.compressor.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	w.buffer.Write(p)
+	if w.buffer.Len() >= w.minBytes {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide writes the held back status and body, compressed or not
+func (w *compressingWriter) decide(compress bool) error {
+	w.decided = true
+	if compress && w.status != http.StatusNoContent && w.status != http.StatusNotModified {
+		header := w.Header()
+		header.Set(echo.HeaderContentEncoding, w.encoding)
+		header.Del(echo.HeaderContentLength)
+		switch w.encoding {
+		case encodingZstd:
+			encoder, err := zstd.NewWriter(w.ResponseWriter, zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				return err
+			}
+			w.compressor = encoder
+		default:
+			w.compressor = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if w.buffer.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.compressor != nil {
+		_, err = w.compressor.Write(w.buffer.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buffer.Bytes())
+	}
+	w.buffer.Reset()
+	return err
+}
+
+// Flush sends what has been written so far. A response that is flushed before it reached minBytes is
+// sent uncompressed.
+func (w *compressingWriter) Flush() {
+	if !w.decided {
+		if err := w.decide(w.buffer.Len() >= w.minBytes); err != nil {
+			return
+		}
+	}
+	if flusher, ok := w.compressor.(interface{ Flush() error }); ok {
+		_ = flusher.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes anything held back and terminates the compressed stream
+func (w *compressingWriter) Close() error {
+	if !w.decided {
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.compressor != nil {
+		return w.compressor.Close()
+	}
+	return nil
+}
+
+// compression decodes compressed request bodies, and compresses responses with the encoding negotiated
+// through Accept-Encoding when compression_enabled is set
+func compression(enabled func() (bool, int)) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if err := decodeRequestBody(c); err != nil {
+				return err.toHTTPError()
+			}
+			on, minBytes := enabled()
+			if !on {
+				return next(c)
+			}
+			c.Response().Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+			encoding := negotiateEncoding(c.Request().Header.Get(echo.HeaderAcceptEncoding))
+			if encoding == "" {
+				return next(c)
+			}
+
+			original := c.Response().Writer
+			writer := newCompressingWriter(original, encoding, minBytes)
+			c.Response().Writer = writer
+			err := next(c)
+			closeErr := writer.Close()
+			// errors are written by the error handler, uncompressed
+			c.Response().Writer = original
+			if err == nil {
+				err = closeErr
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package common_http_transform
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func passThroughTransform() *testTransform {
+	return &testTransform{transform: func(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+		return ec, nil
+	}}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                       "",
+		"identity":               "",
+		"gzip":                   encodingGzip,
+		"gzip, deflate, br":      encodingGzip,
+		"gzip, zstd":             encodingZstd,
+		"zstd;q=0.5, gzip":       encodingGzip,
+		"gzip;q=0, zstd;q=0":     "",
+		"GZIP;q=0.8, br;q=1.0":   encodingGzip,
+		"zstd;q=0.9, gzip;q=0.9": encodingZstd,
+	}
+	for acceptEncoding, expected := range cases {
+		if encoding := negotiateEncoding(acceptEncoding); encoding != expected {
+			t.Errorf("expected %q for Accept-Encoding %q, got %q", expected, acceptEncoding, encoding)
+		}
+	}
+}
+
+func TestTransformDecodesCompressedRequests(t *testing.T) {
+	ws := newTestWebService(t, passThroughTransform())
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, _ = gw.Write([]byte(testEntities))
+	_ = gw.Close()
+	encoder, _ := zstd.NewWriter(nil)
+	zstded := encoder.EncodeAll([]byte(testEntities), nil)
+
+	for encoding, body := range map[string][]byte{encodingGzip: gzipped.Bytes(), encodingZstd: zstded} {
+		rec := postTransform(ws, string(body), map[string]string{echo.HeaderContentEncoding: encoding})
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected %s request body to be decoded, got %d: %s", encoding, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := postTransform(ws, testEntities, map[string]string{echo.HeaderContentEncoding: "br"})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected unsupported encoding to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestTransformCompressesResponses(t *testing.T) {
+	streaming := &testStreamingTransform{}
+	for name, ts := range map[string]TransformService{"collection": passThroughTransform(), "streaming": streaming} {
+		t.Run(name, func(t *testing.T) {
+			ws := newTestWebServiceWithConfig(t, `{"layer_config": {"log_level": "error", "compression_enabled": true, "compression_min_bytes": 100}}`, ts)
+
+			rec := postTransform(ws, testEntities, map[string]string{echo.HeaderAcceptEncoding: "gzip"})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", rec.Code)
+			}
+			if rec.Header().Get(echo.HeaderContentEncoding) != encodingGzip {
+				t.Fatalf("expected gzip response, got %q", rec.Header().Get(echo.HeaderContentEncoding))
+			}
+			reader, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, _ := io.ReadAll(reader)
+			ec, err := egdm.NewEntityParser(egdm.NewNamespaceContext()).WithExpandURIs().LoadEntityCollection(bytes.NewReader(decoded))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ec.Entities) != 2 {
+				t.Errorf("expected 2 entities in decoded response, got %d", len(ec.Entities))
+			}
+
+			// below the minimum size responses are not compressed
+			ws = newTestWebServiceWithConfig(t, `{"layer_config": {"log_level": "error", "compression_enabled": true, "compression_min_bytes": 100000}}`, ts)
+			rec = postTransform(ws, testEntities, map[string]string{echo.HeaderAcceptEncoding: "gzip"})
+			if rec.Header().Get(echo.HeaderContentEncoding) != "" || !strings.HasPrefix(rec.Body.String(), "[") {
+				t.Errorf("expected small response to be uncompressed, got %q", rec.Header().Get(echo.HeaderContentEncoding))
+			}
+		})
+	}
+}
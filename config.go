@@ -1,12 +1,19 @@
 package common_http_transform
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
@@ -22,10 +29,44 @@ type LayerServiceConfig struct {
 	ServiceName           string         `json:"service_name"`
 	Port                  json.Number    `json:"port"`
 	ConfigRefreshInterval string         `json:"config_refresh_interval"`
+	ConfigReloadMode      string         `json:"config_reload_mode"`
 	LogLevel              string         `json:"log_level"`
 	LogFormat             string         `json:"log_format"`
 	StatsdAgentAddress    string         `json:"statsd_agent_address"`
 	StatsdEnabled         bool           `json:"statsd_enabled"`
+	MetricsBackend        string         `json:"metrics_backend"`
+	TransformTimeout      string         `json:"transform_timeout"`
+	ShutdownTimeout       string         `json:"shutdown_timeout"`
+	ShutdownDrainDelay    string         `json:"shutdown_drain_delay"`
+	MaxRequestBytes       int64          `json:"max_request_bytes"`
+	MaxEntitiesPerRequest int            `json:"max_entities_per_request"`
+	MaxConcurrency        int            `json:"max_concurrent_transforms"`
+	MaxQueued             *int           `json:"max_queued_transforms"`
+	MaxQueueWait          string         `json:"max_queue_wait"`
+	CompressionEnabled    bool           `json:"compression_enabled"`
+	CompressionMinBytes   *int           `json:"compression_min_bytes"`
+	PartialFailureEnabled bool           `json:"partial_failure_enabled"`
+	MaxFailureRatio       *float64       `json:"max_failure_ratio"`
+	DeadLetterFile        string         `json:"dead_letter_file"`
+	TracingExporter       string         `json:"tracing_exporter"`
+	TracingEndpoint       string         `json:"tracing_endpoint"`
+	TracingFile           string         `json:"tracing_file"`
+	HealthCheckTTL        string         `json:"health_check_ttl"`
+	HealthCheckTimeout    string         `json:"health_check_timeout"`
+	TLSCertFile           string         `json:"tls_cert_file"`
+	TLSKeyFile            string         `json:"tls_key_file"`
+	TLSClientCAFile       string         `json:"tls_client_ca_file"`
+	TLSClientSubjects     []string       `json:"tls_client_subjects"`
+	JWTEnabled            bool           `json:"jwt_enabled"`
+	JWTIssuer             string         `json:"jwt_issuer"`
+	JWTAudience           string         `json:"jwt_audience"`
+	JWTAlgorithms         []string       `json:"jwt_algorithms"`
+	JWKSURL               string         `json:"jwt_jwks_url"`
+	JWKSFile              string         `json:"jwt_jwks_file"`
+	JWKSRefreshInterval   string         `json:"jwt_jwks_refresh_interval"`
+	AdminEnabled          bool           `json:"admin_enabled"`
+	AdminPort             json.Number    `json:"admin_port"`
+	AdminToken            string         `json:"admin_token"`
 }
 
 /******************************************************************************/
@@ -83,13 +124,74 @@ func newConfig() *Config {
 	return &Config{}
 }
 
+const (
+	configFormatJSON = "json"
+	configFormatYAML = "yaml"
+	configFormatTOML = "toml"
+)
+
+var tomlLine = regexp.MustCompile(`^(\[[\w.\-"]+\]|[\w\-"]+\s*=)`)
+
+// configFormatOf picks the config format from the file extension, falling back to sniffing the content
+func configFormatOf(configPath string, content []byte) string {
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".json":
+		return configFormatJSON
+	case ".yaml", ".yml":
+		return configFormatYAML
+	case ".toml":
+		return configFormatTOML
+	}
+
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) == 0 || trimmed[0] == '{' {
+		return configFormatJSON
+	}
+	for _, line := range bytes.Split(trimmed, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if tomlLine.Match(line) {
+			return configFormatTOML
+		}
+		break
+	}
+	return configFormatYAML
+}
+
 func readConfig(data io.Reader) (*Config, error) {
-	config := newConfig()
 	s, err := io.ReadAll(data)
 	if err != nil {
 		return nil, err
 	}
-	err = json.Unmarshal(s, config)
+	return parseConfig(s, configFormatOf("", s))
+}
+
+// parseConfig decodes yaml and toml into generic values first and then goes through json, so that the
+// json tags on Config are the single definition of the config structure in every format
+func parseConfig(content []byte, format string) (*Config, error) {
+	var err error
+	switch format {
+	case configFormatYAML:
+		var values map[string]any
+		if err = yaml.Unmarshal(content, &values); err != nil {
+			return nil, fmt.Errorf("invalid yaml config: %w", err)
+		}
+		content, err = json.Marshal(values)
+	case configFormatTOML:
+		var values map[string]any
+		if err = toml.Unmarshal(content, &values); err != nil {
+			return nil, fmt.Errorf("invalid toml config: %w", err)
+		}
+		content, err = json.Marshal(values)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config := newConfig()
+	err = json.Unmarshal(content, config)
 	if err != nil {
 		return nil, err
 	}
@@ -97,21 +199,26 @@ func readConfig(data io.Reader) (*Config, error) {
 }
 
 func loadConfig(configPath string) (*Config, error) {
-	reader, err := os.Open(configPath)
+	content, err := os.ReadFile(configPath)
 	if err != nil {
 		return nil, err
 	}
-	config, err := readConfig(reader)
+	config, err := parseConfig(content, configFormatOf(configPath, content))
 	if err != nil {
 		return nil, err
 	}
 
 	config.ConfigFile = configPath
+	addEnvOverrides(config)
 
 	return config, nil
 }
 
 func addEnvOverrides(c *Config) {
+	if c.LayerServiceConfig == nil {
+		c.LayerServiceConfig = &LayerServiceConfig{}
+	}
+
 	val, found := os.LookupEnv("PORT")
 	if found {
 		c.LayerServiceConfig.Port = json.Number(val)
@@ -122,6 +229,11 @@ func addEnvOverrides(c *Config) {
 		c.LayerServiceConfig.ConfigRefreshInterval = val
 	}
 
+	val, found = os.LookupEnv("CONFIG_RELOAD_MODE")
+	if found {
+		c.LayerServiceConfig.ConfigReloadMode = val
+	}
+
 	val, found = os.LookupEnv("SERVICE_NAME")
 	if found {
 		c.LayerServiceConfig.ServiceName = val
@@ -137,6 +249,11 @@ func addEnvOverrides(c *Config) {
 		c.LayerServiceConfig.StatsdAgentAddress = val
 	}
 
+	val, found = os.LookupEnv("METRICS_BACKEND")
+	if found {
+		c.LayerServiceConfig.MetricsBackend = val
+	}
+
 	val, found = os.LookupEnv("LOG_LEVEL")
 	if found {
 		c.LayerServiceConfig.LogLevel = val
@@ -146,4 +263,63 @@ func addEnvOverrides(c *Config) {
 	if found {
 		c.LayerServiceConfig.LogFormat = val
 	}
+
+	val, found = os.LookupEnv("TRACING_EXPORTER")
+	if found {
+		c.LayerServiceConfig.TracingExporter = val
+	}
+
+	val, found = os.LookupEnv("TRACING_ENDPOINT")
+	if found {
+		c.LayerServiceConfig.TracingEndpoint = val
+	}
+
+	val, found = os.LookupEnv("TRANSFORM_TIMEOUT")
+	if found {
+		c.LayerServiceConfig.TransformTimeout = val
+	}
+
+	val, found = os.LookupEnv("SHUTDOWN_TIMEOUT")
+	if found {
+		c.LayerServiceConfig.ShutdownTimeout = val
+	}
+
+	val, found = os.LookupEnv("ADMIN_TOKEN")
+	if found {
+		c.LayerServiceConfig.AdminToken = val
+	}
+}
+
+// warnRestartRequired logs a warning for every changed setting that is only read at startup
+func warnRestartRequired(logger Logger, current *LayerServiceConfig, changed *LayerServiceConfig) {
+	startupOnly := []struct {
+		key            string
+		current, value string
+	}{
+		{"port", current.Port.String(), changed.Port.String()},
+		{"service_name", current.ServiceName, changed.ServiceName},
+		{"config_refresh_interval", current.ConfigRefreshInterval, changed.ConfigRefreshInterval},
+		{"config_reload_mode", current.ConfigReloadMode, changed.ConfigReloadMode},
+		{"tracing_exporter", current.TracingExporter, changed.TracingExporter},
+		{"tracing_endpoint", current.TracingEndpoint, changed.TracingEndpoint},
+		{"tracing_file", current.TracingFile, changed.TracingFile},
+		{"shutdown_timeout", current.ShutdownTimeout, changed.ShutdownTimeout},
+		{"health_check_ttl", current.HealthCheckTTL, changed.HealthCheckTTL},
+		{"health_check_timeout", current.HealthCheckTimeout, changed.HealthCheckTimeout},
+		{"tls enabled", strconv.FormatBool(current.TLSCertFile != ""), strconv.FormatBool(changed.TLSCertFile != "")},
+		{"jwt_enabled", strconv.FormatBool(current.JWTEnabled), strconv.FormatBool(changed.JWTEnabled)},
+		{"jwt_issuer", current.JWTIssuer, changed.JWTIssuer},
+		{"jwt_audience", current.JWTAudience, changed.JWTAudience},
+		{"jwt_algorithms", strings.Join(current.JWTAlgorithms, ","), strings.Join(changed.JWTAlgorithms, ",")},
+		{"jwt_jwks_url", current.JWKSURL, changed.JWKSURL},
+		{"jwt_jwks_file", current.JWKSFile, changed.JWKSFile},
+		{"jwt_jwks_refresh_interval", current.JWKSRefreshInterval, changed.JWKSRefreshInterval},
+		{"admin_enabled", strconv.FormatBool(current.AdminEnabled), strconv.FormatBool(changed.AdminEnabled)},
+		{"admin_port", current.AdminPort.String(), changed.AdminPort.String()},
+	}
+	for _, setting := range startupOnly {
+		if setting.current != setting.value {
+			logger.Warn(fmt.Sprintf("%s changed from %q to %q, restart required to take effect", setting.key, setting.current, setting.value))
+		}
+	}
 }
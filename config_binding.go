@@ -0,0 +1,371 @@
+package common_http_transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ConfigBindingError lists every problem found while binding ExternalSystemConfig
+type ConfigBindingError struct {
+	Errors []error
+}
+
+func (e *ConfigBindingError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return "invalid external_config: " + strings.Join(msgs, "; ")
+}
+
+func (e *ConfigBindingError) Unwrap() []error {
+	return e.Errors
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	urlType      = reflect.TypeOf(url.URL{})
+)
+
+// BindExternalConfig decodes the ExternalSystemConfig of cfg into a struct of type T. Fields are matched by
+// the `config` tag, falling back to the `json` tag and then the lower cased field name. Supported tags:
+//
+//	config:"timeout"              key in external_config, "-" to skip the field
+//	default:"30s"                 value used when the key is missing
+//	validate:"required,min=1"     required, min and max; min and max compare numbers and durations
+//	                              by value, strings and slices by length
+//	pattern:"^https://"           regular expression a string value must match
+//
+// Besides the basic kinds, time.Duration ("30s", "5m") and url.URL / *url.URL (absolute urls) are supported.
+// Strings are accepted for every scalar type, so values set from environment variables bind as well.
+// Every failure is reported together in a *ConfigBindingError.
+//
+// Call it in the service factory and again in UpdateConfiguration, or register a ConfigBinding with the
+// ServiceRunner to have every reloaded config checked before it is applied.
+func BindExternalConfig[T any](cfg *Config) (T, error) {
+	var target T
+	v := reflect.ValueOf(&target).Elem()
+	if v.Kind() != reflect.Struct {
+		return target, fmt.Errorf("BindExternalConfig requires a struct type, got %s", v.Type())
+	}
+
+	var values map[string]any
+	if cfg != nil {
+		values = cfg.ExternalSystemConfig
+	}
+	errs := bindStruct(v, values, "")
+	if len(errs) > 0 {
+		return target, &ConfigBindingError{Errors: errs}
+	}
+	return target, nil
+}
+
+// ConfigBinding holds the ExternalSystemConfig of the running service bound to T. Registered with
+// ServiceRunner.WithConfigBinding, the config is bound when the service starts, and every reloaded config is
+// bound when it is validated, before any part of the service applies it. A config that does not bind is
+// rejected and the running config is kept.
+type ConfigBinding[T any] struct {
+	current  atomic.Pointer[T]
+	onChange func(T)
+}
+
+// NewConfigBinding returns a binding of external_config to T. onChange, if not nil, is called with the
+// value bound from every config that is applied, including the one the service starts with.
+func NewConfigBinding[T any](onChange func(T)) *ConfigBinding[T] {
+	return &ConfigBinding[T]{onChange: onChange}
+}
+
+// Get returns the value bound from the config in use, or the zero value before the service is configured
+func (b *ConfigBinding[T]) Get() T {
+	if current := b.current.Load(); current != nil {
+		return *current
+	}
+	var zero T
+	return zero
+}
+
+func (b *ConfigBinding[T]) ValidateConfiguration(config *Config) error {
+	_, err := BindExternalConfig[T](config)
+	return err
+}
+
+func (b *ConfigBinding[T]) UpdateConfiguration(config *Config) TransformError {
+	value, err := BindExternalConfig[T](config)
+	if err != nil {
+		return Err(err, LayerErrorBadParameter)
+	}
+	b.current.Store(&value)
+	if b.onChange != nil {
+		b.onChange(value)
+	}
+	return nil
+}
+
+func bindStruct(v reflect.Value, values map[string]any, prefix string) []error {
+	var errs []error
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		key := configKey(field)
+		if key == "-" {
+			continue
+		}
+		path := prefix + key
+
+		rules := parseValidateTag(field.Tag.Get("validate"))
+		raw, present := values[key]
+		if !present || raw == nil {
+			if def, hasDefault := field.Tag.Lookup("default"); hasDefault {
+				raw, present = def, true
+			}
+		}
+		if !present || raw == nil {
+			if _, required := rules["required"]; required {
+				errs = append(errs, fmt.Errorf("%s is required", path))
+			}
+			continue
+		}
+
+		fv := v.Field(i)
+		if isNestedStruct(field.Type) {
+			nested, ok := raw.(map[string]any)
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: expected an object, got %T", path, raw))
+				continue
+			}
+			errs = append(errs, bindStruct(fv, nested, path+".")...)
+			continue
+		}
+
+		if err := setValue(fv, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		errs = append(errs, validateValue(path, fv, rules, field.Tag.Get("pattern"))...)
+	}
+	return errs
+}
+
+func configKey(field reflect.StructField) string {
+	if key, ok := field.Tag.Lookup("config"); ok && key != "" {
+		return key
+	}
+	if key, _, _ := strings.Cut(field.Tag.Get("json"), ","); key != "" {
+		return key
+	}
+	return strings.ToLower(field.Name)
+}
+
+func isNestedStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != urlType
+}
+
+func parseValidateTag(tag string) map[string]string {
+	rules := make(map[string]string)
+	for _, rule := range strings.Split(tag, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		name, arg, _ := strings.Cut(rule, "=")
+		rules[name] = arg
+	}
+	return rules
+}
+
+func setValue(fv reflect.Value, raw any) error {
+	switch fv.Type() {
+	case durationType:
+		s, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("expected a duration such as 30s, got %v", raw)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		fv.SetInt(int64(d))
+		return nil
+	case urlType, reflect.PointerTo(urlType):
+		s, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("expected a url, got %v", raw)
+		}
+		u, err := url.Parse(s)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid absolute url %q", s)
+		}
+		if fv.Kind() == reflect.Pointer {
+			fv.Set(reflect.ValueOf(u))
+		} else {
+			fv.Set(reflect.ValueOf(*u))
+		}
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		switch r := raw.(type) {
+		case string:
+			fv.SetString(r)
+		case float64, bool, int, int64, json.Number:
+			fv.SetString(fmt.Sprint(r))
+		default:
+			return fmt.Errorf("expected a string, got %T", raw)
+		}
+	case reflect.Bool:
+		switch r := raw.(type) {
+		case bool:
+			fv.SetBool(r)
+		case string:
+			b, err := strconv.ParseBool(r)
+			if err != nil {
+				return fmt.Errorf("invalid boolean %q", r)
+			}
+			fv.SetBool(b)
+		default:
+			return fmt.Errorf("expected a boolean, got %T", raw)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f, err := toFloat(raw)
+		if err != nil {
+			return err
+		}
+		if f != math.Trunc(f) || fv.OverflowInt(int64(f)) {
+			return fmt.Errorf("%v is not a valid %s", raw, fv.Type())
+		}
+		fv.SetInt(int64(f))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f, err := toFloat(raw)
+		if err != nil {
+			return err
+		}
+		if f < 0 || f != math.Trunc(f) || fv.OverflowUint(uint64(f)) {
+			return fmt.Errorf("%v is not a valid %s", raw, fv.Type())
+		}
+		fv.SetUint(uint64(f))
+	case reflect.Float32, reflect.Float64:
+		f, err := toFloat(raw)
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(f)
+	case reflect.Slice:
+		var items []any
+		switch r := raw.(type) {
+		case []any:
+			items = r
+		case string:
+			// comma separated, as set from environment variables
+			for _, item := range strings.Split(r, ",") {
+				items = append(items, strings.TrimSpace(item))
+			}
+		default:
+			return fmt.Errorf("expected a list, got %T", raw)
+		}
+		slice := reflect.MakeSlice(fv.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setValue(slice.Index(i), item); err != nil {
+				return fmt.Errorf("item %d: %w", i, err)
+			}
+		}
+		fv.Set(slice)
+	default:
+		// maps and other types are decoded through json
+		data, err := json.Marshal(raw)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(data, fv.Addr().Interface()); err != nil {
+			return fmt.Errorf("expected %s: %w", fv.Type(), err)
+		}
+	}
+	return nil
+}
+
+func toFloat(raw any) (float64, error) {
+	switch r := raw.(type) {
+	case float64:
+		return r, nil
+	case int:
+		return float64(r), nil
+	case int64:
+		return float64(r), nil
+	case json.Number:
+		return r.Float64()
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(r), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", r)
+		}
+		return f, nil
+	default:
+		return 0, fmt.Errorf("expected a number, got %T", raw)
+	}
+}
+
+func validateValue(path string, fv reflect.Value, rules map[string]string, pattern string) []error {
+	var errs []error
+	for _, bound := range []string{"min", "max"} {
+		arg, ok := rules[bound]
+		if !ok {
+			continue
+		}
+		actual, limit, err := boundValues(fv, arg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid %s rule: %w", path, bound, err))
+			continue
+		}
+		if bound == "min" && actual < limit {
+			errs = append(errs, fmt.Errorf("%s must be at least %s", path, arg))
+		}
+		if bound == "max" && actual > limit {
+			errs = append(errs, fmt.Errorf("%s must be at most %s", path, arg))
+		}
+	}
+
+	if pattern != "" && fv.Kind() == reflect.String {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid pattern rule: %w", path, err))
+		} else if !re.MatchString(fv.String()) {
+			errs = append(errs, fmt.Errorf("%s must match %s", path, pattern))
+		}
+	}
+	return errs
+}
+
+// boundValues returns the value of fv and the limit parsed from arg, for min and max rules
+func boundValues(fv reflect.Value, arg string) (float64, float64, error) {
+	if fv.Type() == durationType {
+		limit, err := time.ParseDuration(arg)
+		return float64(fv.Int()), float64(limit), err
+	}
+	limit, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch fv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(fv.Int()), limit, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(fv.Uint()), limit, nil
+	case reflect.Float32, reflect.Float64:
+		return fv.Float(), limit, nil
+	case reflect.String, reflect.Slice, reflect.Map:
+		return float64(fv.Len()), limit, nil
+	default:
+		return 0, 0, fmt.Errorf("not supported for %s", fv.Type())
+	}
+}
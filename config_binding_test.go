@@ -0,0 +1,133 @@
+package common_http_transform
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type weatherConfig struct {
+	Endpoint *url.URL      `config:"endpoint" validate:"required"`
+	APIKey   string        `config:"api_key" validate:"required,min=8" pattern:"^[a-z0-9]+$"`
+	Timeout  time.Duration `config:"timeout" default:"30s" validate:"max=1m"`
+	Retries  int           `config:"retries" default:"3" validate:"min=0,max=10"`
+	Regions  []string      `config:"regions"`
+	Cache    struct {
+		Enabled bool `json:"enabled"`
+		Size    int  `json:"size" validate:"min=1"`
+	} `config:"cache"`
+}
+
+func TestBindExternalConfig(t *testing.T) {
+	cfg, err := readConfig(strings.NewReader(`{"external_config": {
+		"endpoint": "https://weather.example.com/api",
+		"api_key": "abcdef123",
+		"retries": 5,
+		"regions": "north, south",
+		"cache": {"enabled": true, "size": 100}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bound, err := BindExternalConfig[weatherConfig](cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bound.Endpoint.Host != "weather.example.com" {
+		t.Errorf("expected endpoint host weather.example.com, got %s", bound.Endpoint.Host)
+	}
+	if bound.Timeout != 30*time.Second {
+		t.Errorf("expected default timeout of 30s, got %s", bound.Timeout)
+	}
+	if bound.Retries != 5 {
+		t.Errorf("expected 5 retries, got %d", bound.Retries)
+	}
+	if len(bound.Regions) != 2 || bound.Regions[1] != "south" {
+		t.Errorf("expected regions north and south, got %v", bound.Regions)
+	}
+	if !bound.Cache.Enabled || bound.Cache.Size != 100 {
+		t.Errorf("expected nested cache config to bind, got %+v", bound.Cache)
+	}
+}
+
+func TestBindExternalConfig_ReportsAllFailures(t *testing.T) {
+	cfg, err := readConfig(strings.NewReader(`{"external_config": {
+		"api_key": "ABC",
+		"timeout": "5m",
+		"retries": "many",
+		"cache": {"size": 0}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = BindExternalConfig[weatherConfig](cfg)
+	var bindingErr *ConfigBindingError
+	if !errors.As(err, &bindingErr) {
+		t.Fatalf("expected ConfigBindingError, got %v", err)
+	}
+	for _, expected := range []string{
+		"endpoint is required",
+		"api_key must be at least 8",
+		"api_key must match",
+		"timeout must be at most 1m",
+		"retries: invalid number",
+		"cache.size must be at least 1",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in %s", expected, err.Error())
+		}
+	}
+	if len(bindingErr.Errors) != 6 {
+		t.Errorf("expected 6 failures, got %d", len(bindingErr.Errors))
+	}
+}
+
+type timeoutConfig struct {
+	Timeout time.Duration `config:"timeout" validate:"required"`
+}
+
+func TestConfigBindingRejectsReloadThatDoesNotBind(t *testing.T) {
+	const layerConfig = `"layer_config": {"service_name": "test", "log_level": "error", "config_reload_mode": "poll", "config_refresh_interval": "1h"}`
+	configFile := writeTestConfig(t, `{`+layerConfig+`, "external_config": {"timeout": "5s"}}`)
+	var applied []time.Duration
+	binding := NewConfigBinding(func(c timeoutConfig) { applied = append(applied, c.Timeout) })
+	runner := NewServiceRunner(newTestTransform).WithConfigLocation(configFile).WithConfigBinding(binding)
+	if err := runner.configure(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = runner.Stop() }()
+	if binding.Get().Timeout != 5*time.Second {
+		t.Fatalf("expected the start config to be bound, got %v", binding.Get())
+	}
+
+	if err := os.WriteFile(configFile, []byte(`{`+layerConfig+`, "external_config": {"timeout": "soon"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if event := runner.configUpdater.forceReload(); event.Outcome != configReloadInvalid {
+		t.Errorf("expected a config that does not bind to be rejected, got %+v", event)
+	}
+	if binding.Get().Timeout != 5*time.Second || runner.configUpdater.currentConfig().ExternalSystemConfig["timeout"] != "5s" {
+		t.Errorf("expected the running config to be kept, got %v", binding.Get())
+	}
+
+	if err := os.WriteFile(configFile, []byte(`{`+layerConfig+`, "external_config": {"timeout": "10s"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if event := runner.configUpdater.forceReload(); event.Outcome != configReloadApplied {
+		t.Errorf("expected a config that binds to be applied, got %+v", event)
+	}
+	if binding.Get().Timeout != 10*time.Second || len(applied) != 2 {
+		t.Errorf("expected the reloaded config to be bound, got %v after %v", binding.Get(), applied)
+	}
+
+	configFile = writeTestConfig(t, `{`+layerConfig+`, "external_config": {}}`)
+	err := NewServiceRunner(newTestTransform).WithConfigLocation(configFile).WithConfigBinding(NewConfigBinding[timeoutConfig](nil)).Start()
+	if !errors.Is(err, ErrConfigLoad) {
+		t.Errorf("expected a start config that does not bind to fail with ErrConfigLoad, got %v", err)
+	}
+}
@@ -6,7 +6,7 @@ import (
 )
 
 func TestConfig(t *testing.T) {
-	config, err := loadConfig("./testdata")
+	config, err := loadConfig("./testdata/config.json")
 	if err != nil {
 		t.Error(err)
 	}
@@ -27,7 +27,7 @@ func TestConfig_AddEnvOverrides(t *testing.T) {
 	t.Setenv("LOG_LEVEL", "debug")
 	t.Setenv("LOG_FORMAT", "json")
 
-	config, err := loadConfig("./testdata")
+	config, err := loadConfig("./testdata/config.json")
 	if err != nil {
 		t.Error(err)
 	}
@@ -64,3 +64,40 @@ func TestConfig_PortAsNumber(t *testing.T) {
 		t.Error("Port should be 8000")
 	}
 }
+
+func TestConfig_Formats(t *testing.T) {
+	expected, err := loadConfig("./testdata/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"./testdata/config.yaml", "./testdata/config.toml"} {
+		config, err := loadConfig(file)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		config.ConfigFile = expected.ConfigFile
+		if !expected.equals(config) {
+			t.Errorf("%s: expected %+v, got %+v", file, expected.LayerServiceConfig, config.LayerServiceConfig)
+		}
+	}
+}
+
+func TestConfig_FormatSniffing(t *testing.T) {
+	cases := map[string]string{
+		`{ "layer_config": { "service_name": "sniffed" } }`:       configFormatJSON,
+		"layer_config:\n  service_name: sniffed\n":                configFormatYAML,
+		"# comment\n[layer_config]\nservice_name = \"sniffed\"\n": configFormatTOML,
+	}
+	for content, format := range cases {
+		if actual := configFormatOf("./config", []byte(content)); actual != format {
+			t.Errorf("expected %s to be sniffed as %s, got %s", content, format, actual)
+		}
+		conf, err := readConfig(strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conf.LayerServiceConfig.ServiceName != "sniffed" {
+			t.Errorf("expected service name from %s config", format)
+		}
+	}
+}
@@ -3,19 +3,82 @@ package common_http_transform
 import (
 	"context"
 	"fmt"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	ConfigReloadModeWatch = "watch"
+	ConfigReloadModePoll  = "poll"
+
+	// configReloadDebounce is how long the watcher waits for a burst of file events to settle
+	configReloadDebounce = 500 * time.Millisecond
+)
+
+// ConfigValidator can optionally be implemented by a TransformService. When the config file changes,
+// ValidateConfiguration is called on every listener before any of them is given the new config, so that
+// a change can be rejected without being half applied.
+type ConfigValidator interface {
+	ValidateConfiguration(config *Config) error
+}
+
+// configListener is notified by the configUpdater when the config changes
+type configListener interface {
+	UpdateConfiguration(config *Config) TransformError
+}
+
+const (
+	configReloadApplied        = "applied"
+	configReloadInvalid        = "invalid"
+	configReloadRolledBack     = "rolled_back"
+	configReloadRollbackFailed = "rollback_failed"
+	configReloadLoadFailed     = "load_failed"
+
+	// maxConfigReloadHistory is the number of reload attempts kept for the admin api
+	maxConfigReloadHistory = 20
 )
 
+// configReloadEvent records the outcome of one attempt to reload the config
+type configReloadEvent struct {
+	Time    time.Time `json:"time"`
+	Outcome string    `json:"outcome"`
+	Forced  bool      `json:"forced,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
 type configUpdater struct {
-	ticker *time.Ticker
-	logger Logger
-	config *Config
+	ticker   *time.Ticker
+	watcher  *fsnotify.Watcher
+	done     chan struct{}
+	stopOnce sync.Once
+	logger   Logger
+	metrics  Metrics
+	config   *Config
+	// rejected is the last config that failed to apply, it is not retried until the file changes again
+	rejected *Config
+	// mu serialises reloads, and guards config and history for readers outside the reload goroutine
+	mu      sync.Mutex
+	history []configReloadEvent
+	// forceReload reloads and applies the config file even if it is unchanged
+	forceReload func() configReloadEvent
 }
 
 func (u *configUpdater) Stop(ctx context.Context) error {
 	u.logger.Info("Stopping config updater")
-	u.ticker.Stop()
+	u.stopOnce.Do(func() {
+		close(u.done)
+		if u.ticker != nil {
+			u.ticker.Stop()
+		}
+		if u.watcher != nil {
+			_ = u.watcher.Close()
+		}
+	})
 	return nil
 }
 
@@ -25,6 +88,9 @@ func asDuration(durationExpr string) (time.Duration, error) {
 		"m": time.Minute,
 		"h": time.Hour,
 	}
+	if len(durationExpr) < 2 {
+		return 0, fmt.Errorf("invalid duration expression: %v. valid examples: 90s, 1m, 3h", durationExpr)
+	}
 	num, err := strconv.Atoi(durationExpr[:len(durationExpr)-1])
 	if err != nil {
 		return 0, fmt.Errorf("invalid number in expression: %v. valid examples: 90s, 1m, 3h", durationExpr)
@@ -36,13 +102,19 @@ func asDuration(durationExpr string) (time.Duration, error) {
 	return time.Duration(num) * unitDuration, nil
 }
 
+// newConfigUpdater starts watching the config file for changes. In watch mode (the default) file system
+// events trigger a reload; if the watcher cannot be set up it falls back to polling every
+// config_refresh_interval, which is also used when config_reload_mode is poll.
 func newConfigUpdater(
 	config *Config,
 	enrichConfig func(config *Config) error,
 	l Logger,
-	listeners ...TransformService,
+	metrics Metrics,
+	listeners ...configListener,
 ) (*configUpdater, error) {
-	u := &configUpdater{logger: l}
+	u := &configUpdater{logger: l, metrics: metrics, done: make(chan struct{})}
+	u.config = config
+
 	interval := 5 * time.Second
 	if config.LayerServiceConfig.ConfigRefreshInterval != "" {
 		var err error
@@ -51,41 +123,254 @@ func newConfigUpdater(
 			return nil, err
 		}
 	}
-	u.ticker = time.NewTicker(interval)
-	u.config = config
 
+	check := func() {
+		u.checkForUpdates(enrichConfig, l, listeners...)
+	}
+	u.forceReload = func() configReloadEvent {
+		return u.reload(true, enrichConfig, l, listeners...)
+	}
+
+	mode := strings.ToLower(config.LayerServiceConfig.ConfigReloadMode)
+	switch mode {
+	case "", ConfigReloadModeWatch:
+		err := u.startWatching(config.ConfigFile, check)
+		if err == nil {
+			return u, nil
+		}
+		l.Warn(fmt.Sprintf("Failed to watch config file, falling back to polling every %s", interval), "error", err.Error())
+	case ConfigReloadModePoll:
+	default:
+		return nil, fmt.Errorf("unknown config_reload_mode %s, expected one of watch, poll", mode)
+	}
+
+	u.startPolling(interval, check)
+	return u, nil
+}
+
+func (u *configUpdater) startPolling(interval time.Duration, check func()) {
+	u.ticker = pollEvery(interval, u.done, check)
+}
+
+func (u *configUpdater) startWatching(configFile string, check func()) error {
+	watcher, err := watchFiles([]string{configFile}, u.done, u.logger, check)
+	if err != nil {
+		return err
+	}
+	u.watcher = watcher
+	return nil
+}
+
+// pollEvery calls check every interval until done is closed
+func pollEvery(interval time.Duration, done <-chan struct{}, check func()) *time.Ticker {
+	ticker := time.NewTicker(interval)
 	go func() {
-		for range u.ticker.C {
-			u.checkForUpdates(enrichConfig, l, listeners...)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				check()
+			}
 		}
 	}()
-	return u, nil
+	return ticker
 }
 
-func (u *configUpdater) checkForUpdates(enrichConfig func(config *Config) error, logger Logger, listeners ...TransformService) {
+// watchFiles watches the directories of the files rather than the files themselves, so that files
+// replaced by rename, and Kubernetes ConfigMap and Secret updates that swap the ..data symlink, are
+// picked up. Bursts of events are debounced into a single call to onChange. Watching ends when done
+// is closed.
+func watchFiles(files []string, done <-chan struct{}, logger Logger, onChange func()) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	dirs := map[string]bool{}
+	for _, file := range files {
+		names[filepath.Base(file)] = true
+		dirs[filepath.Dir(file)] = true
+		if resolved, err := filepath.EvalSymlinks(file); err == nil {
+			names[filepath.Base(resolved)] = true
+			dirs[filepath.Dir(resolved)] = true
+		}
+	}
+	for dir := range dirs {
+		if err = watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return nil, err
+		}
+	}
+
+	relevant := func(event fsnotify.Event) bool {
+		name := filepath.Base(event.Name)
+		return names[name] || strings.HasPrefix(name, "..data")
+	}
+
+	go func() {
+		var debounce <-chan time.Time
+		var timer *time.Timer
+		for {
+			select {
+			case <-done:
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Has(fsnotify.Chmod) || !relevant(event) {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.NewTimer(configReloadDebounce)
+				debounce = timer.C
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Warn("File watcher error", "error", err.Error())
+			case <-debounce:
+				debounce = nil
+				onChange()
+			}
+		}
+	}()
+	return watcher, nil
+}
+
+func (u *configUpdater) checkForUpdates(enrichConfig func(config *Config) error, logger Logger, listeners ...configListener) {
+	u.reload(false, enrichConfig, logger, listeners...)
+}
+
+// reload loads the config file and applies it if it changed. A forced reload applies it even if it
+// is unchanged or was rejected before. An unchanged config returns an event without outcome.
+func (u *configUpdater) reload(force bool, enrichConfig func(config *Config) error, logger Logger, listeners ...configListener) configReloadEvent {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
 	logger.Debug("checking config for updates in " + u.config.ConfigFile + ".")
 	loadedConf, err := loadConfig(u.config.ConfigFile)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Failed to load config: %v", err.Error()))
-		return
+		return u.reportReload(force, configReloadLoadFailed, err)
 	}
 	if enrichConfig != nil {
 		err = enrichConfig(loadedConf)
 		if err != nil {
 			logger.Error(fmt.Sprintf("Failed to enrich config: %v", err.Error()))
-			return
+			return u.reportReload(force, configReloadLoadFailed, err)
 		}
 	}
-	if !u.config.equals(loadedConf) {
-		logger.Info("Config changed, updating...")
-		for _, listener := range listeners {
-			err = listener.UpdateConfiguration(loadedConf)
-			if err != nil {
-				logger.Error(fmt.Sprintf("Failed to update config: %v", err.Error()))
-				return
+	if !force {
+		if u.config.equals(loadedConf) {
+			return configReloadEvent{Time: time.Now()}
+		}
+		if u.rejected != nil && u.rejected.equals(loadedConf) {
+			logger.Debug("config unchanged since it was last rejected")
+			return configReloadEvent{Time: time.Now()}
+		}
+	}
+
+	logger.Info("Config changed, updating...")
+	outcome, err := u.applyConfig(loadedConf, listeners)
+	event := u.reportReload(force, outcome, err)
+	if outcome != configReloadApplied {
+		u.rejected = loadedConf
+		return event
+	}
+	// set config to the new loaded config
+	u.config = loadedConf
+	u.rejected = nil
+	return event
+}
+
+// lastReloadError returns the error of the last reload attempt, or nil if it was applied or there was none
+func (u *configUpdater) lastReloadError() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.history) == 0 {
+		return nil
+	}
+	last := u.history[len(u.history)-1]
+	if last.Outcome == configReloadApplied {
+		return nil
+	}
+	return fmt.Errorf("config reload %s: %s", last.Outcome, last.Error)
+}
+
+// currentConfig returns the config that was last applied successfully
+func (u *configUpdater) currentConfig() *Config {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.config
+}
+
+// reloadHistory returns the most recent reload attempts, oldest first
+func (u *configUpdater) reloadHistory() []configReloadEvent {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]configReloadEvent(nil), u.history...)
+}
+
+// applyConfig validates the new config with every listener, then applies it to each in turn. If a
+// listener fails to apply it, the listeners that already did are rolled back to the current config.
+// The returned error is the cause of any outcome other than applied.
+func (u *configUpdater) applyConfig(newConfig *Config, listeners []configListener) (string, error) {
+	for _, listener := range listeners {
+		if validator, ok := listener.(ConfigValidator); ok {
+			if err := validator.ValidateConfiguration(newConfig); err != nil {
+				u.logger.Error(fmt.Sprintf("Config change rejected, validation failed: %v", err.Error()))
+				return configReloadInvalid, err
+			}
+		}
+	}
+
+	for i, listener := range listeners {
+		err := listener.UpdateConfiguration(newConfig)
+		if err == nil {
+			continue
+		}
+		u.logger.Error(fmt.Sprintf("Failed to update config: %v", err.Error()))
+
+		outcome := configReloadRolledBack
+		for j := i - 1; j >= 0; j-- {
+			if rollbackErr := listeners[j].UpdateConfiguration(u.config); rollbackErr != nil {
+				u.logger.Error(fmt.Sprintf("Failed to roll back config: %v", rollbackErr.Error()))
+				outcome = configReloadRollbackFailed
 			}
 		}
-		// set config to the new loaded config
-		u.config = loadedConf
+		if outcome == configReloadRolledBack {
+			u.logger.Warn("Config change rolled back, previous config is still active")
+		}
+		return outcome, err
+	}
+
+	u.logger.Info("Config updated")
+	return configReloadApplied, nil
+}
+
+// reportReload counts the outcome in the config.reload metric and records it in the reload history
+func (u *configUpdater) reportReload(forced bool, outcome string, err error) configReloadEvent {
+	event := configReloadEvent{Time: time.Now(), Outcome: outcome, Forced: forced}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	u.history = append(u.history, event)
+	if len(u.history) > maxConfigReloadHistory {
+		u.history = u.history[len(u.history)-maxConfigReloadHistory:]
+	}
+
+	if u.metrics != nil {
+		if err := u.metrics.Incr("config.reload", []string{"outcome:" + outcome}, 1); err != nil {
+			u.logger.Warn("Error with metrics", "error", err.Error())
+		}
 	}
+	return event
 }
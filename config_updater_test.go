@@ -0,0 +1,245 @@
+package common_http_transform
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingListener struct {
+	testTransform
+	updates chan *Config
+}
+
+func (r *recordingListener) UpdateConfiguration(config *Config) TransformError {
+	r.updates <- config
+	return nil
+}
+
+func testConfigContent(serviceName string) string {
+	return fmt.Sprintf(`{"layer_config": {"service_name": %q, "config_reload_mode": "watch"}}`, serviceName)
+}
+
+func startTestConfigUpdater(t *testing.T, configFile string) *recordingListener {
+	t.Helper()
+	config, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &recordingListener{updates: make(chan *Config, 10)}
+	u, err := newConfigUpdater(config, nil, NewLogger("test", "json", "error"), nil, listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.watcher == nil {
+		t.Fatal("expected config updater to watch the config file")
+	}
+	t.Cleanup(func() { _ = u.Stop(context.Background()) })
+	return listener
+}
+
+func expectUpdate(t *testing.T, listener *recordingListener, serviceName string) {
+	t.Helper()
+	select {
+	case config := <-listener.updates:
+		if config.LayerServiceConfig.ServiceName != serviceName {
+			t.Errorf("expected updated service name %s, got %s", serviceName, config.LayerServiceConfig.ServiceName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected config update")
+	}
+}
+
+func TestConfigUpdater_WatchDebouncesWrites(t *testing.T) {
+	configFile := writeTestConfig(t, testConfigContent("initial"))
+	listener := startTestConfigUpdater(t, configFile)
+
+	for i := 0; i < 5; i++ {
+		if err := os.WriteFile(configFile, []byte(testConfigContent(fmt.Sprintf("update-%d", i))), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectUpdate(t, listener, "update-4")
+
+	select {
+	case config := <-listener.updates:
+		t.Errorf("expected a single update for a burst of writes, got another for %s", config.LayerServiceConfig.ServiceName)
+	case <-time.After(2 * configReloadDebounce):
+	}
+}
+
+func TestConfigUpdater_WatchConfigMapSymlinkSwap(t *testing.T) {
+	// lay out the directory the way kubernetes mounts a ConfigMap
+	dir := t.TempDir()
+	writeVersion := func(version, serviceName string) {
+		if err := os.Mkdir(filepath.Join(dir, version), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, version, "config.json"), []byte(testConfigContent(serviceName)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeVersion("..2024_01_01", "initial")
+	if err := os.Symlink("..2024_01_01", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.json")
+	if err := os.Symlink(filepath.Join("..data", "config.json"), configFile); err != nil {
+		t.Fatal(err)
+	}
+	listener := startTestConfigUpdater(t, configFile)
+
+	writeVersion("..2024_01_02", "swapped")
+	if err := os.Symlink("..2024_01_02", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "..2024_01_01")); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate(t, listener, "swapped")
+}
+
+func TestConfigUpdater_PollMode(t *testing.T) {
+	configFile := writeTestConfig(t, `{"layer_config": {"config_reload_mode": "poll", "config_refresh_interval": "1s"}}`)
+	config, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := newConfigUpdater(config, nil, NewLogger("test", "json", "error"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop(context.Background())
+	if u.ticker == nil || u.watcher != nil {
+		t.Error("expected config updater to poll")
+	}
+
+	config.LayerServiceConfig.ConfigReloadMode = "sometimes"
+	if _, err = newConfigUpdater(config, nil, NewLogger("test", "json", "error"), nil); err == nil {
+		t.Error("expected unknown config_reload_mode to be rejected")
+	}
+}
+
+type transactionalListener struct {
+	testTransform
+	applied  []string
+	fail     bool
+	validate func(config *Config) error
+}
+
+func (l *transactionalListener) UpdateConfiguration(config *Config) TransformError {
+	if l.fail {
+		return Errorf(LayerErrorBadParameter, "cannot apply %s", config.LayerServiceConfig.ServiceName)
+	}
+	l.applied = append(l.applied, config.LayerServiceConfig.ServiceName)
+	return nil
+}
+
+type validatingListener struct {
+	transactionalListener
+}
+
+func (l *validatingListener) ValidateConfiguration(config *Config) error {
+	return l.validate(config)
+}
+
+type countingMetrics struct {
+	StatsdMetrics
+	counts map[string]int
+	gauges map[string]float64
+}
+
+func (m *countingMetrics) Incr(name string, tags []string, _ int) TransformError {
+	m.counts[name+" "+strings.Join(tags, ",")]++
+	return nil
+}
+
+func (m *countingMetrics) Timing(_ string, _ time.Duration, _ []string, _ int) TransformError {
+	return nil
+}
+
+// Gauge records the last value, if the gauges map is set
+func (m *countingMetrics) Gauge(name string, value float64, tags []string, _ int) TransformError {
+	if m.gauges != nil {
+		m.gauges[name+" "+strings.Join(tags, ",")] = value
+	}
+	return nil
+}
+
+func TestConfigUpdater_RollsBackOnFailure(t *testing.T) {
+	configFile := writeTestConfig(t, `{"layer_config": {"service_name": "v1", "config_reload_mode": "poll"}}`)
+	config, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := &transactionalListener{}
+	failing := &transactionalListener{fail: true}
+	last := &transactionalListener{}
+	metrics := &countingMetrics{counts: map[string]int{}}
+	u := &configUpdater{logger: NewLogger("test", "json", "error"), metrics: metrics, config: config}
+
+	if err = os.WriteFile(configFile, []byte(`{"layer_config": {"service_name": "v2", "config_reload_mode": "poll"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	u.checkForUpdates(nil, u.logger, first, failing, last)
+	u.checkForUpdates(nil, u.logger, first, failing, last)
+
+	if strings.Join(first.applied, ",") != "v2,v1" {
+		t.Errorf("expected first listener to be rolled back to v1, got %v", first.applied)
+	}
+	if len(last.applied) != 0 {
+		t.Errorf("expected last listener not to be updated, got %v", last.applied)
+	}
+	if u.config.LayerServiceConfig.ServiceName != "v1" {
+		t.Errorf("expected v1 to remain active, got %s", u.config.LayerServiceConfig.ServiceName)
+	}
+	if metrics.counts["config.reload outcome:rolled_back"] != 1 {
+		t.Errorf("expected a single rolled back reload, got %v", metrics.counts)
+	}
+
+	failing.fail = false
+	if err = os.WriteFile(configFile, []byte(`{"layer_config": {"service_name": "v3", "config_reload_mode": "poll"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	u.checkForUpdates(nil, u.logger, first, failing, last)
+	if u.config.LayerServiceConfig.ServiceName != "v3" || strings.Join(last.applied, ",") != "v3" {
+		t.Errorf("expected v3 to be applied, got %s", u.config.LayerServiceConfig.ServiceName)
+	}
+	if metrics.counts["config.reload outcome:applied"] != 1 {
+		t.Errorf("expected an applied reload, got %v", metrics.counts)
+	}
+}
+
+func TestConfigUpdater_ValidatesBeforeApplying(t *testing.T) {
+	configFile := writeTestConfig(t, `{"layer_config": {"service_name": "v1", "config_reload_mode": "poll"}}`)
+	config, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := &transactionalListener{}
+	validating := &validatingListener{transactionalListener{validate: func(config *Config) error {
+		if config.LayerServiceConfig.ServiceName == "invalid" {
+			return fmt.Errorf("service name must not be invalid")
+		}
+		return nil
+	}}}
+	u := &configUpdater{logger: NewLogger("test", "json", "error"), metrics: &countingMetrics{counts: map[string]int{}}, config: config}
+
+	if err = os.WriteFile(configFile, []byte(`{"layer_config": {"service_name": "invalid", "config_reload_mode": "poll"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	u.checkForUpdates(nil, u.logger, first, validating)
+	if len(first.applied) != 0 || len(validating.applied) != 0 {
+		t.Errorf("expected no listener to be updated with an invalid config")
+	}
+	if u.rejected == nil || u.config.LayerServiceConfig.ServiceName != "v1" {
+		t.Error("expected invalid config to be rejected")
+	}
+}
@@ -0,0 +1,199 @@
+package common_http_transform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+// EntityTransformer transforms a single entity. It may return no entities to drop the input,
+// or several to expand it. Use NewEntityTransformService to host it as a TransformService.
+type EntityTransformer interface {
+	TransformEntity(ctx context.Context, entity *egdm.Entity) ([]*egdm.Entity, error)
+}
+
+// EntityErrorMode decides how EntityTransformService reacts to an entity failing
+type EntityErrorMode int
+
+const (
+	// CancelOnFirstError cancels the remaining work as soon as one entity fails
+	CancelOnFirstError EntityErrorMode = iota
+	// CollectAllErrors processes every entity and reports all failures together as a PartialFailure,
+	// alongside the successfully transformed entities
+	CollectAllErrors
+)
+
+const defaultEntityConcurrency = 10
+
+// EntityTransformService runs an EntityTransformer over every entity in a collection using a bounded
+// pool of workers. The order of the input is preserved in the output. Stop and UpdateConfiguration are
+// forwarded to the transformer if it implements them, as are ValidateConfiguration and CheckHealth.
+type EntityTransformService struct {
+	transformer EntityTransformer
+	concurrency int
+	errorMode   EntityErrorMode
+}
+
+func NewEntityTransformService(transformer EntityTransformer) *EntityTransformService {
+	return &EntityTransformService{transformer: transformer, concurrency: defaultEntityConcurrency}
+}
+
+// WithConcurrency sets the number of entities transformed in parallel
+func (s *EntityTransformService) WithConcurrency(concurrency int) *EntityTransformService {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	s.concurrency = concurrency
+	return s
+}
+
+func (s *EntityTransformService) WithErrorMode(errorMode EntityErrorMode) *EntityTransformService {
+	s.errorMode = errorMode
+	return s
+}
+
+func (s *EntityTransformService) Stop(ctx context.Context) error {
+	if stoppable, ok := s.transformer.(Stoppable); ok {
+		return stoppable.Stop(ctx)
+	}
+	return nil
+}
+
+func (s *EntityTransformService) UpdateConfiguration(config *Config) TransformError {
+	if updatable, ok := s.transformer.(interface {
+		UpdateConfiguration(config *Config) TransformError
+	}); ok {
+		return updatable.UpdateConfiguration(config)
+	}
+	return nil
+}
+
+func (s *EntityTransformService) ValidateConfiguration(config *Config) error {
+	if validator, ok := s.transformer.(ConfigValidator); ok {
+		return validator.ValidateConfiguration(config)
+	}
+	return nil
+}
+
+func (s *EntityTransformService) CheckHealth(ctx context.Context) map[string]error {
+	if checker, ok := s.transformer.(HealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
+}
+
+func (s *EntityTransformService) Transform(entityCollection *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	return s.transformWithContext(context.Background(), entityCollection)
+}
+
+func (s *EntityTransformService) transformWithContext(ctx context.Context, entityCollection *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	results, failures, err := s.transformEntities(ctx, entityCollection.Entities)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, Err(ctxErr, LayerErrorInternal)
+	}
+	if err != nil {
+		return nil, Err(err, errorTypeOf(err))
+	}
+
+	result := egdm.NewEntityCollection(entityCollection.NamespaceManager)
+	for _, entities := range results {
+		for _, entity := range entities {
+			_ = result.AddEntity(entity)
+		}
+	}
+	return result, PartialFailure(failures...)
+}
+
+// transformEntities returns the outputs per input index. In CancelOnFirstError mode the error that
+// triggered the cancellation is returned, otherwise every failed entity is returned as EntityFailure.
+func (s *EntityTransformService) transformEntities(ctx context.Context, entities []*egdm.Entity) ([][]*egdm.Entity, []EntityFailure, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([][]*egdm.Entity, len(entities))
+	errs := make([]error, len(entities))
+	var firstErr error
+	var once sync.Once
+
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < s.concurrency && w < len(entities); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				out, err := s.transformEntity(ctx, entities[i])
+				if err != nil {
+					errs[i] = err
+					if s.errorMode == CancelOnFirstError {
+						once.Do(func() {
+							firstErr = entityError{id: entities[i].ID, err: err}
+							cancel()
+						})
+					}
+					continue
+				}
+				results[i] = out
+			}
+		}()
+	}
+
+feed:
+	for i := range entities {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
+	var failures []EntityFailure
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, EntityFailure{Entity: entities[i], Err: err})
+		}
+	}
+	return results, failures, nil
+}
+
+// transformEntity calls the transformer, turning a panic into an error so that a single bad entity
+// cannot take down the worker pool
+func (s *EntityTransformService) transformEntity(ctx context.Context, entity *egdm.Entity) (out []*egdm.Entity, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.transformer.TransformEntity(ctx, entity)
+}
+
+// entityError attributes a failure to the entity that caused it
+type entityError struct {
+	id  string
+	err error
+}
+
+func (e entityError) Error() string {
+	return fmt.Sprintf("entity %s: %s", e.id, e.err.Error())
+}
+
+func (e entityError) Unwrap() error {
+	return e.err
+}
+
+// errorTypeOf returns the type of the first TransformError in the chain of err, defaulting to LayerErrorInternal
+func errorTypeOf(err error) LayerErrorType {
+	var te TransformError
+	if errors.As(err, &te) {
+		return te.Type()
+	}
+	return LayerErrorInternal
+}
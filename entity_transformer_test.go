@@ -0,0 +1,119 @@
+package common_http_transform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+type funcEntityTransformer func(ctx context.Context, entity *egdm.Entity) ([]*egdm.Entity, error)
+
+func (f funcEntityTransformer) TransformEntity(ctx context.Context, entity *egdm.Entity) ([]*egdm.Entity, error) {
+	return f(ctx, entity)
+}
+
+func makeEntities(n int) *egdm.EntityCollection {
+	ec := egdm.NewEntityCollection(nil)
+	for i := 0; i < n; i++ {
+		_ = ec.AddEntity(egdm.NewEntity().SetID(fmt.Sprintf("http://example.com/%d", i)))
+	}
+	return ec
+}
+
+func TestEntityTransformServicePreservesOrder(t *testing.T) {
+	service := NewEntityTransformService(funcEntityTransformer(func(_ context.Context, entity *egdm.Entity) ([]*egdm.Entity, error) {
+		var n int
+		_, _ = fmt.Sscanf(entity.ID, "http://example.com/%d", &n)
+		// later entities finish first
+		time.Sleep(time.Duration(100-n) * 100 * time.Microsecond)
+		switch n % 3 {
+		case 0:
+			return nil, nil
+		case 1:
+			return []*egdm.Entity{entity}, nil
+		default:
+			return []*egdm.Entity{entity, egdm.NewEntity().SetID(entity.ID + "/copy")}, nil
+		}
+	})).WithConcurrency(8)
+
+	result, err := service.Transform(makeEntities(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("http://example.com/%d", i)
+		switch i % 3 {
+		case 1:
+			expected = append(expected, id)
+		case 2:
+			expected = append(expected, id, id+"/copy")
+		}
+	}
+	if len(result.Entities) != len(expected) {
+		t.Fatalf("expected %d entities, got %d", len(expected), len(result.Entities))
+	}
+	for i, entity := range result.Entities {
+		if entity.ID != expected[i] {
+			t.Fatalf("expected entity %d to be %s, got %s", i, expected[i], entity.ID)
+		}
+	}
+}
+
+func TestEntityTransformServiceCancelOnFirstError(t *testing.T) {
+	var calls atomic.Int32
+	service := NewEntityTransformService(funcEntityTransformer(func(ctx context.Context, entity *egdm.Entity) ([]*egdm.Entity, error) {
+		calls.Add(1)
+		if entity.ID == "http://example.com/3" {
+			return nil, Errorf(LayerErrorUpstreamUnavailable, "lookup failed")
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+			return []*egdm.Entity{entity}, nil
+		}
+	})).WithConcurrency(2)
+
+	_, err := service.Transform(makeEntities(1000))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if err.Type() != LayerErrorUpstreamUnavailable {
+		t.Errorf("expected error type %s, got %s", LayerErrorUpstreamUnavailable, err.Type())
+	}
+	if !strings.Contains(err.Error(), "http://example.com/3") {
+		t.Errorf("expected error to name the failing entity, got %s", err.Error())
+	}
+	if calls.Load() > 10 {
+		t.Errorf("expected remaining entities to be skipped, got %d calls", calls.Load())
+	}
+}
+
+func TestEntityTransformServiceCollectAllErrors(t *testing.T) {
+	service := NewEntityTransformService(funcEntityTransformer(func(_ context.Context, entity *egdm.Entity) ([]*egdm.Entity, error) {
+		if strings.HasSuffix(entity.ID, "0") {
+			return nil, errors.New("bad entity")
+		}
+		if entity.ID == "http://example.com/5" {
+			panic("boom")
+		}
+		return []*egdm.Entity{entity}, nil
+	})).WithErrorMode(CollectAllErrors)
+
+	_, err := service.Transform(makeEntities(30))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, id := range []string{"/0", "/10", "/20", "/5"} {
+		if !strings.Contains(err.Error(), "http://example.com"+id+":") {
+			t.Errorf("expected error to contain entity %s, got %s", id, err.Error())
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package common_http_transform
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
 
 	"github.com/labstack/echo/v4"
 )
@@ -12,12 +14,69 @@ const (
 	LayerErrorBadParameter LayerErrorType = iota
 	LayerErrorInternal
 	LayerNotSupported
+	LayerErrorUpstreamTimeout
+	LayerErrorUpstreamUnavailable
+	LayerErrorRateLimited
+	LayerErrorUnauthorized
+	LayerErrorForbidden
+	LayerErrorPayloadTooLarge
 )
 
+// String returns the short name of the error type, used as problem type in error responses
+func (t LayerErrorType) String() string {
+	switch t {
+	case LayerErrorBadParameter:
+		return "bad_parameter"
+	case LayerErrorInternal:
+		return "internal"
+	case LayerNotSupported:
+		return "not_supported"
+	case LayerErrorUpstreamTimeout:
+		return "upstream_timeout"
+	case LayerErrorUpstreamUnavailable:
+		return "upstream_unavailable"
+	case LayerErrorRateLimited:
+		return "rate_limited"
+	case LayerErrorUnauthorized:
+		return "unauthorized"
+	case LayerErrorForbidden:
+		return "forbidden"
+	case LayerErrorPayloadTooLarge:
+		return "payload_too_large"
+	default:
+		return "internal"
+	}
+}
+
+// HTTPStatus returns the HTTP status code that the error type is reported with
+func (t LayerErrorType) HTTPStatus() int {
+	switch t {
+	case LayerErrorBadParameter:
+		return http.StatusBadRequest
+	case LayerNotSupported:
+		return http.StatusNotImplemented
+	case LayerErrorUpstreamTimeout:
+		return http.StatusGatewayTimeout
+	case LayerErrorUpstreamUnavailable:
+		return http.StatusServiceUnavailable
+	case LayerErrorRateLimited:
+		return http.StatusTooManyRequests
+	case LayerErrorUnauthorized:
+		return http.StatusUnauthorized
+	case LayerErrorForbidden:
+		return http.StatusForbidden
+	case LayerErrorPayloadTooLarge:
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 type TransformError interface {
 	error
 	toHTTPError() *echo.HTTPError
 	Underlying() error
+	Type() LayerErrorType
 }
 
 type transformError struct {
@@ -29,9 +88,23 @@ func (l transformError) Underlying() error {
 	return l.err
 }
 
+func (l transformError) Unwrap() error {
+	return l.err
+}
+
+func (l transformError) Type() LayerErrorType {
+	return l.errType
+}
+
 func (l transformError) toHTTPError() *echo.HTTPError {
-	// TODO: map LayerErrorType to HTTP status code and message
-	return echo.NewHTTPError(500, l.err.Error())
+	status := l.errType.HTTPStatus()
+	p := &problem{
+		Type:   l.errType.String(),
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: l.err.Error(),
+	}
+	return echo.NewHTTPError(status, p).SetInternal(l.err)
 }
 
 func (l transformError) Error() string {
@@ -48,3 +121,46 @@ func Err(err error, errType LayerErrorType) TransformError {
 func Errorf(errType LayerErrorType, format string, args ...any) TransformError {
 	return &transformError{err: fmt.Errorf(format, args...), errType: errType}
 }
+
+/******************************************************************************/
+
+const mimeApplicationProblemJSON = "application/problem+json"
+
+// problem is an RFC 7807 problem details body, extended with the request id
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// toProblem converts any error returned by a handler into a problem body. Errors that are
+// neither TransformError nor echo.HTTPError are reported without detail, to avoid leaking internals.
+func toProblem(err error) *problem {
+	var he *echo.HTTPError
+	var te TransformError
+	switch {
+	case errors.As(err, &he):
+	case errors.As(err, &te):
+		he = te.toHTTPError()
+	default:
+		return &problem{
+			Type:   LayerErrorInternal.String(),
+			Title:  http.StatusText(http.StatusInternalServerError),
+			Status: http.StatusInternalServerError,
+		}
+	}
+
+	if p, ok := he.Message.(*problem); ok {
+		cp := *p
+		return &cp
+	}
+
+	return &problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(he.Code),
+		Status: he.Code,
+		Detail: fmt.Sprintf("%v", he.Message),
+	}
+}
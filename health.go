@@ -0,0 +1,184 @@
+package common_http_transform
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// HealthChecker can optionally be implemented by a TransformService to report the status of the systems
+// it depends on. CheckHealth returns one entry per dependency, a nil error meaning the dependency is healthy.
+// The results decide whether /health/ready reports the service as ready.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) map[string]error
+}
+
+const (
+	HealthStatusUp       = "up"
+	HealthStatusDown     = "down"
+	HealthStatusDraining = "draining"
+
+	defaultHealthCheckTTL     = 5 * time.Second
+	defaultHealthCheckTimeout = 5 * time.Second
+)
+
+type healthReport struct {
+	Status    string                       `json:"status"`
+	Checks    map[string]healthCheckResult `json:"checks,omitempty"`
+	CheckedAt time.Time                    `json:"checked_at"`
+}
+
+type healthCheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// health answers the liveness and readiness probes. Readiness runs the HealthChecker of the transform
+// service and the built-in checks, and caches the result for health_check_ttl.
+type health struct {
+	checker HealthChecker
+	// configStatus reports whether the last config reload failed, it is set once the config updater runs
+	configStatus func() error
+	ttl          time.Duration
+	timeout      time.Duration
+	draining     atomic.Bool
+
+	mu     sync.Mutex
+	cached *healthReport
+}
+
+func newHealth(config *Config, transformService TransformService) (*health, error) {
+	h := &health{ttl: defaultHealthCheckTTL, timeout: defaultHealthCheckTimeout}
+	h.checker, _ = transformService.(HealthChecker)
+	if ttl := config.LayerServiceConfig.HealthCheckTTL; ttl != "" {
+		d, err := asDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health_check_ttl: %w", err)
+		}
+		h.ttl = d
+	}
+	if timeout := config.LayerServiceConfig.HealthCheckTimeout; timeout != "" {
+		d, err := asDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health_check_timeout: %w", err)
+		}
+		h.timeout = d
+	}
+	return h, nil
+}
+
+// addChecker adds the checks of a named transform service, if it implements HealthChecker
+func (h *health) addChecker(name string, transformService TransformService) {
+	checker, ok := transformService.(HealthChecker)
+	if !ok {
+		return
+	}
+	checkers, ok := h.checker.(namedHealthCheckers)
+	if !ok {
+		checkers = namedHealthCheckers{}
+		if h.checker != nil {
+			checkers[""] = h.checker
+		}
+		h.checker = checkers
+	}
+	checkers[name] = checker
+}
+
+// namedHealthCheckers runs the checkers of several transform services, prefixing the checks with the
+// name of the service. The checks of the default service, named "", are not prefixed.
+type namedHealthCheckers map[string]HealthChecker
+
+func (n namedHealthCheckers) CheckHealth(ctx context.Context) map[string]error {
+	results := map[string]error{}
+	for prefix, checker := range n {
+		for name, err := range checker.CheckHealth(ctx) {
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			results[name] = err
+		}
+	}
+	return results
+}
+
+// drain makes the readiness probe fail, so that no new traffic is routed to the service while it stops
+func (h *health) drain() {
+	h.draining.Store(true)
+}
+
+func (h *health) live(c echo.Context) error {
+	return c.JSON(http.StatusOK, healthReport{Status: HealthStatusUp, CheckedAt: time.Now()})
+}
+
+func (h *health) ready(c echo.Context) error {
+	if h.draining.Load() {
+		return c.JSON(http.StatusServiceUnavailable, healthReport{Status: HealthStatusDraining, CheckedAt: time.Now()})
+	}
+	// the report is shared by all probes until it expires, so a client going away must not fail it
+	report := h.check(context.WithoutCancel(c.Request().Context()))
+	status := http.StatusOK
+	if report.Status != HealthStatusUp {
+		status = http.StatusServiceUnavailable
+	}
+	return c.JSON(status, report)
+}
+
+// check returns the cached report, or runs all checks if it has expired
+func (h *health) check(ctx context.Context) *healthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cached != nil && time.Since(h.cached.CheckedAt) < h.ttl {
+		return h.cached
+	}
+
+	results := map[string]error{}
+	if h.configStatus != nil {
+		results["config"] = h.configStatus()
+	}
+	if h.checker != nil {
+		for name, err := range h.runChecker(ctx) {
+			results[name] = err
+		}
+	}
+
+	report := &healthReport{Status: HealthStatusUp, Checks: map[string]healthCheckResult{}, CheckedAt: time.Now()}
+	for name, err := range results {
+		if err != nil {
+			report.Status = HealthStatusDown
+			report.Checks[name] = healthCheckResult{Status: HealthStatusDown, Error: err.Error()}
+		} else {
+			report.Checks[name] = healthCheckResult{Status: HealthStatusUp}
+		}
+	}
+	h.cached = report
+	return report
+}
+
+// runChecker calls the HealthChecker with health_check_timeout, reporting a checker that does not
+// return in time as a failed check
+func (h *health) runChecker(ctx context.Context) map[string]error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	done := make(chan map[string]error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- map[string]error{"health_checker": fmt.Errorf("health check panicked: %v", r)}
+			}
+		}()
+		done <- h.checker.CheckHealth(ctx)
+	}()
+
+	select {
+	case results := <-done:
+		return results
+	case <-ctx.Done():
+		return map[string]error{"health_checker": fmt.Errorf("health check did not complete within %s", h.timeout)}
+	}
+}
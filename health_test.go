@@ -0,0 +1,79 @@
+package common_http_transform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type checkedTransform struct {
+	testTransform
+	calls int
+	err   error
+	delay time.Duration
+}
+
+func (ct *checkedTransform) CheckHealth(ctx context.Context) map[string]error {
+	ct.calls++
+	select {
+	case <-time.After(ct.delay):
+	case <-ctx.Done():
+	}
+	return map[string]error{"upstream": ct.err}
+}
+
+func getHealth(ws *transformWebService, path string) (*httptest.ResponseRecorder, *healthReport) {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	rec := httptest.NewRecorder()
+	ws.e.ServeHTTP(rec, req)
+	report := &healthReport{}
+	_ = json.Unmarshal(rec.Body.Bytes(), report)
+	return rec, report
+}
+
+func TestHealthReadyReportsChecks(t *testing.T) {
+	checked := &checkedTransform{err: errors.New("connection refused")}
+	ws := newTestWebServiceWithConfig(t, `{"layer_config": {"log_level": "error", "health_check_ttl": "1h"}}`, checked)
+
+	rec, report := getHealth(ws, "/health/ready")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", rec.Code)
+	}
+	if report.Checks["upstream"].Error != "connection refused" {
+		t.Errorf("expected failed upstream check in report, got %+v", report.Checks)
+	}
+
+	// cached until the ttl expires
+	checked.err = nil
+	getHealth(ws, "/health/ready")
+	if checked.calls != 1 {
+		t.Errorf("expected cached result to be reused, checker called %d times", checked.calls)
+	}
+
+	if rec, _ := getHealth(ws, "/health/live"); rec.Code != http.StatusOK {
+		t.Errorf("expected liveness to be independent of checks, got %d", rec.Code)
+	}
+
+	ws.health.drain()
+	rec, report = getHealth(ws, "/health/ready")
+	if rec.Code != http.StatusServiceUnavailable || report.Status != HealthStatusDraining {
+		t.Errorf("expected draining service not to be ready, got %d %s", rec.Code, report.Status)
+	}
+}
+
+func TestHealthReadyCheckTimeout(t *testing.T) {
+	checked := &checkedTransform{delay: time.Minute}
+	ws := newTestWebServiceWithConfig(t, `{"layer_config": {"log_level": "error", "health_check_timeout": "1s"}}`, checked)
+
+	rec, report := getHealth(ws, "/health/ready")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", rec.Code)
+	}
+	if report.Checks["health_checker"].Status != HealthStatusDown {
+		t.Errorf("expected timed out checker to be reported, got %+v", report.Checks)
+	}
+}
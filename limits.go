@@ -0,0 +1,229 @@
+package common_http_transform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// defaultQueueWait is used when max_queue_wait is not set
+const defaultQueueWait = 10 * time.Second
+
+// entityLimitError stops parsing when a request has more than max_entities_per_request entities
+type entityLimitError struct {
+	max int
+}
+
+func (e *entityLimitError) Error() string {
+	return fmt.Sprintf("request has more than %d entities", e.max)
+}
+
+// countEntities returns an error for the entity after the first max entities. A max of 0 means no limit.
+func countEntities(max int) func() error {
+	seen := 0
+	return func() error {
+		seen++
+		if max > 0 && seen > max {
+			return &entityLimitError{max: max}
+		}
+		return nil
+	}
+}
+
+// limitRequestBody rejects requests that declare a body larger than max_request_bytes, and makes reading
+// past max_request_bytes fail for the others
+func limitRequestBody(c echo.Context, maxBytes int64) TransformError {
+	if maxBytes <= 0 {
+		return nil
+	}
+	if c.Request().ContentLength > maxBytes {
+		return Errorf(LayerErrorPayloadTooLarge, "request body of %d bytes exceeds the limit of %d bytes", c.Request().ContentLength, maxBytes)
+	}
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxBytes)
+	return nil
+}
+
+// parseError translates an error from parsing the request body into an error response, reporting
+// requests over the size or entity limits as 413
+func (ws *transformWebService) parseError(c echo.Context, err error) error {
+	var bytesErr *http.MaxBytesError
+	var entitiesErr *entityLimitError
+	reason := ""
+	switch {
+	case errors.As(err, &bytesErr):
+		reason = "bytes"
+		err = fmt.Errorf("request body exceeds the limit of %d bytes", bytesErr.Limit)
+	case errors.As(err, &entitiesErr):
+		reason = "entities"
+		err = entitiesErr
+	default:
+		return Errorf(LayerErrorBadParameter, "could not parse the request body: %s", err.Error()).toHTTPError()
+	}
+	ws.reportRejected(c, reason)
+	return Err(err, LayerErrorPayloadTooLarge).toHTTPError()
+}
+
+func (ws *transformWebService) reportRejected(c echo.Context, reason string) {
+	tags := []string{"url:" + c.Request().URL.Path, "reason:" + reason}
+	if err := ws.metrics.Incr("transform.request.rejected", tags, 1); err != nil {
+		ws.logger.Warn("Error with metrics", "error", err.Error())
+	}
+}
+
+// transformLimits are the concurrency settings of layer_config. A maxConcurrent of 0 means no limit.
+type transformLimits struct {
+	maxConcurrent int
+	maxQueued     int
+	queueWait     time.Duration
+}
+
+func transformLimitsOf(conf *LayerServiceConfig) (transformLimits, error) {
+	if conf.MaxConcurrency <= 0 {
+		return transformLimits{}, nil
+	}
+	limits := transformLimits{maxConcurrent: conf.MaxConcurrency, maxQueued: conf.MaxConcurrency, queueWait: defaultQueueWait}
+	if conf.MaxQueued != nil {
+		if *conf.MaxQueued < 0 {
+			return limits, fmt.Errorf("invalid max_queued_transforms %d, must not be negative", *conf.MaxQueued)
+		}
+		limits.maxQueued = *conf.MaxQueued
+	}
+	if conf.MaxQueueWait != "" {
+		wait, err := asDuration(conf.MaxQueueWait)
+		if err != nil {
+			return limits, fmt.Errorf("invalid max_queue_wait: %w", err)
+		}
+		limits.queueWait = wait
+	}
+	return limits, nil
+}
+
+// retryAfter is the number of seconds clients are asked to wait before retrying a shed request
+func (t transformLimits) retryAfter() string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(t.queueWait.Seconds()))))
+}
+
+// transformLimiter bounds the number of concurrent transforms. Requests over the limit wait in a
+// bounded queue for up to max_queue_wait; requests that find the queue full are shed immediately.
+// It lives as long as the web service: a config reload resizes it, so that the transforms already
+// running keep counting against the new limits.
+type transformLimiter struct {
+	mu      sync.Mutex
+	limits  transformLimits
+	running int
+	waiting []chan struct{}
+}
+
+func newTransformLimiter(limits transformLimits) *transformLimiter {
+	return &transformLimiter{limits: limits}
+}
+
+// resize applies changed limits. Lowering max_concurrent_transforms below the number of running
+// transforms admits no one until enough of them have completed; raising it admits waiting requests.
+func (l *transformLimiter) resize(limits transformLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+	l.admit()
+}
+
+// admit hands free slots to the waiting requests in order, mu must be held
+func (l *transformLimiter) admit() {
+	for len(l.waiting) > 0 && (l.limits.maxConcurrent == 0 || l.running < l.limits.maxConcurrent) {
+		close(l.waiting[0])
+		l.waiting = l.waiting[1:]
+		l.running++
+	}
+}
+
+// leave removes a request from the queue. It returns false if the request was admitted meanwhile,
+// in which case release must be called.
+func (l *transformLimiter) leave(admitted chan struct{}) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, waiting := range l.waiting {
+		if waiting == admitted {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (l *transformLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	l.admit()
+}
+
+// acquire waits for a transform slot. Requests that find the queue full get a 429, requests that time
+// out in the queue a 503, both with a Retry-After header. A nil error means release must be called.
+func (ws *transformWebService) acquire(ctx context.Context, c echo.Context, l *transformLimiter) TransformError {
+	l.mu.Lock()
+	limits := l.limits
+	if limits.maxConcurrent == 0 || l.running < limits.maxConcurrent {
+		l.running++
+		l.mu.Unlock()
+		ws.reportConcurrency(l)
+		return nil
+	}
+	if len(l.waiting) >= limits.maxQueued {
+		l.mu.Unlock()
+		return ws.shed(c, limits, "queue_full", Errorf(LayerErrorRateLimited, "too many concurrent transforms, try again later"))
+	}
+	admitted := make(chan struct{})
+	l.waiting = append(l.waiting, admitted)
+	l.mu.Unlock()
+	ws.reportConcurrency(l)
+
+	start := time.Now()
+	timer := time.NewTimer(limits.queueWait)
+	defer timer.Stop()
+	var timedOut bool
+	select {
+	case <-admitted:
+		_ = ws.metrics.Timing("transform.queue.wait", time.Since(start), nil, 1)
+		ws.reportConcurrency(l)
+		return nil
+	case <-timer.C:
+		timedOut = true
+	case <-ctx.Done():
+	}
+	if !l.leave(admitted) {
+		// admitted while giving up, the slot goes to the next request
+		l.release()
+	}
+	ws.reportConcurrency(l)
+	if timedOut {
+		return ws.shed(c, limits, "queue_timeout", Errorf(LayerErrorUpstreamUnavailable, "no transform capacity within %s, try again later", limits.queueWait))
+	}
+	return Err(ctx.Err(), LayerErrorUpstreamTimeout)
+}
+
+func (ws *transformWebService) shed(c echo.Context, limits transformLimits, reason string, err TransformError) TransformError {
+	c.Response().Header().Set("Retry-After", limits.retryAfter())
+	if metricsErr := ws.metrics.Incr("transform.shed", []string{"reason:" + reason}, 1); metricsErr != nil {
+		ws.logger.Warn("Error with metrics", "error", metricsErr.Error())
+	}
+	ws.logger.Warn("Transform request shed", "reason", reason)
+	return err
+}
+
+// reportConcurrency reports the running and queued transforms, if max_concurrent_transforms is set
+func (ws *transformWebService) reportConcurrency(l *transformLimiter) {
+	l.mu.Lock()
+	limited, running, queued := l.limits.maxConcurrent > 0, l.running, len(l.waiting)
+	l.mu.Unlock()
+	if limited {
+		_ = ws.metrics.Gauge("transform.concurrent", float64(running), nil, 1)
+		_ = ws.metrics.Gauge("transform.queued", float64(queued), nil, 1)
+	}
+}
@@ -0,0 +1,140 @@
+package common_http_transform
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func TestTransformRequestLimits(t *testing.T) {
+	ws := newTestWebServiceWithConfig(t, `{"layer_config": {"log_level": "error", "max_request_bytes": 200, "max_entities_per_request": 1}}`, &testTransform{})
+
+	rec := postTransform(ws, testEntities, nil)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected body over max_request_bytes to be rejected with 413, got %d", rec.Code)
+	}
+
+	// without a content length the limit is enforced while reading
+	req := httptest.NewRequest(http.MethodPost, "/transform", strings.NewReader(testEntities))
+	req.ContentLength = -1
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	ws.e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected streamed body over max_request_bytes to be rejected with 413, got %d", rec.Code)
+	}
+
+	ws = newTestWebServiceWithConfig(t, `{"layer_config": {"log_level": "error", "max_entities_per_request": 1}}`, &testTransform{})
+	rec = postTransform(ws, testEntities, nil)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected request over max_entities_per_request to be rejected with 413, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "more than 1 entities") {
+		t.Errorf("expected entity limit in problem detail, got %s", rec.Body.String())
+	}
+}
+
+func TestTransformConcurrencyLimit(t *testing.T) {
+	cases := map[string]struct {
+		conf   string
+		status int
+	}{
+		"queue full":    {`{"layer_config": {"log_level": "error", "max_concurrent_transforms": 1, "max_queued_transforms": 0}}`, http.StatusTooManyRequests},
+		"queue timeout": {`{"layer_config": {"log_level": "error", "max_concurrent_transforms": 1, "max_queued_transforms": 1, "max_queue_wait": "1s"}}`, http.StatusServiceUnavailable},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			bt := &blockingTransform{started: make(chan struct{}), release: make(chan struct{})}
+			ws := newTestWebServiceWithConfig(t, tc.conf, ContextTransform(bt))
+
+			done := make(chan int)
+			go func() {
+				done <- postTransform(ws, testEntities, nil).Code
+			}()
+			<-bt.started
+
+			rec := postTransform(ws, testEntities, nil)
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d, got %d", tc.status, rec.Code)
+			}
+			if rec.Header().Get("Retry-After") == "" {
+				t.Error("expected Retry-After header")
+			}
+
+			close(bt.release)
+			if code := <-done; code != http.StatusOK {
+				t.Errorf("expected admitted transform to complete, got %d", code)
+			}
+		})
+	}
+}
+
+func TestTransformConcurrencyLimitIsResizedOnReload(t *testing.T) {
+	bt := &blockingTransform{started: make(chan struct{}), release: make(chan struct{})}
+	ws := newTestWebServiceWithConfig(t, `{"layer_config": {"log_level": "error", "max_concurrent_transforms": 2, "max_queued_transforms": 0}}`, ContextTransform(bt))
+
+	done := make(chan int)
+	go func() {
+		done <- postTransform(ws, testEntities, nil).Code
+	}()
+	<-bt.started
+
+	// the running transform counts against the lowered limit
+	config, _ := readConfig(strings.NewReader(`{"layer_config": {"log_level": "error", "max_concurrent_transforms": 1, "max_queued_transforms": 0}}`))
+	if err := ws.UpdateConfiguration(config); err != nil {
+		t.Fatal(err)
+	}
+	if rec := postTransform(ws, testEntities, nil); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the running transform to fill the lowered limit, got %d", rec.Code)
+	}
+
+	close(bt.release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("expected admitted transform to complete, got %d", code)
+	}
+	if running, queued := ws.limiter.running, len(ws.limiter.waiting); running != 0 || queued != 0 {
+		t.Errorf("expected the slot to be released, got %d running and %d queued", running, queued)
+	}
+}
+
+// firstBlocksTransform blocks the first call until its context is done, and returns the others straight away
+type firstBlocksTransform struct {
+	testTransform
+	calls atomic.Int32
+}
+
+func (ft *firstBlocksTransform) Transform(ctx context.Context, ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	if ft.calls.Add(1) == 1 {
+		<-ctx.Done()
+		return nil, Err(ctx.Err(), LayerErrorInternal)
+	}
+	return ec, nil
+}
+
+func TestTransformTimeoutStartsAfterQueueWait(t *testing.T) {
+	ft := &firstBlocksTransform{}
+	ws := newTestWebServiceWithConfig(t, `{"layer_config": {"log_level": "error", "transform_timeout": "1s", "max_concurrent_transforms": 1, "max_queue_wait": "5s"}}`, ContextTransform(ft))
+
+	first := make(chan int)
+	go func() {
+		first <- postTransform(ws, testEntities, nil).Code
+	}()
+	for ft.calls.Load() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// queued for about the transform_timeout of the first transform, then given its own
+	if rec := postTransform(ws, testEntities, nil); rec.Code != http.StatusOK {
+		t.Errorf("expected the queued transform to get the full transform_timeout, got %d", rec.Code)
+	}
+	if code := <-first; code != http.StatusGatewayTimeout {
+		t.Errorf("expected the blocking transform to time out, got %d", code)
+	}
+}
@@ -1,11 +1,15 @@
 package common_http_transform
 
 import (
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -29,6 +33,14 @@ type Logger interface {
 	With(name string, value string) Logger
 }
 
+// LevelOverrider can optionally be implemented by a Logger given with WithLogger, so that PUT /admin/log-level
+// can change its level. OverrideLevel sets one of debug, info, warn or error until ClearLevelOverride is called;
+// a change of log_level in the meantime must not end the override.
+type LevelOverrider interface {
+	OverrideLevel(level string)
+	ClearLevelOverride()
+}
+
 /******************************************************************************/
 
 type StatsdMetrics struct {
@@ -47,31 +59,254 @@ func (sm StatsdMetrics) Gauge(name string, value float64, tags []string, rate in
 	return Err(sm.client.Gauge(name, value, tags, float64(rate)), LayerErrorInternal)
 }
 
-func newMetrics(conf *Config) (Metrics, error) {
-	var client statsd.ClientInterface
-	if conf.LayerServiceConfig.StatsdEnabled {
-		c, err := statsd.New(conf.LayerServiceConfig.StatsdAgentAddress,
-			statsd.WithNamespace(conf.LayerServiceConfig.ServiceName),
-			statsd.WithTags([]string{"application:" + conf.LayerServiceConfig.ServiceName}))
+// taggedMetrics adds tags to everything reported through it
+type taggedMetrics struct {
+	metrics Metrics
+	tags    []string
+}
+
+func withTags(metrics Metrics, tags ...string) Metrics {
+	return &taggedMetrics{metrics: metrics, tags: tags}
+}
+
+func (tm *taggedMetrics) with(tags []string) []string {
+	return append(append(make([]string, 0, len(tm.tags)+len(tags)), tm.tags...), tags...)
+}
+
+func (tm *taggedMetrics) Incr(name string, tags []string, rate int) TransformError {
+	return tm.metrics.Incr(name, tm.with(tags), rate)
+}
+
+func (tm *taggedMetrics) Timing(name string, value time.Duration, tags []string, rate int) TransformError {
+	return tm.metrics.Timing(name, value, tm.with(tags), rate)
+}
+
+func (tm *taggedMetrics) Gauge(name string, value float64, tags []string, rate int) TransformError {
+	return tm.metrics.Gauge(name, value, tm.with(tags), rate)
+}
+
+const (
+	MetricsBackendStatsd     = "statsd"
+	MetricsBackendPrometheus = "prometheus"
+	MetricsBackendNone       = "none"
+)
+
+// metricsBackend returns the backend selected by metrics_backend. When metrics_backend is not set,
+// statsd_enabled decides between statsd and none.
+func metricsBackend(conf *LayerServiceConfig) string {
+	backend := strings.ToLower(conf.MetricsBackend)
+	if backend == "" {
+		backend = MetricsBackendNone
+		if conf.StatsdEnabled {
+			backend = MetricsBackendStatsd
+		}
+	}
+	return backend
+}
+
+// newMetrics creates the Metrics implementation selected by the config. The returned Metrics
+// follows config changes to the statsd settings.
+func newMetrics(conf *Config, logger Logger) (Metrics, error) {
+	current, err := buildMetrics(conf.LayerServiceConfig)
+	if err != nil {
+		return nil, err
+	}
+	rm := &reloadableMetrics{logger: logger, conf: *conf.LayerServiceConfig}
+	rm.current.Store(&metricsGeneration{metrics: current})
+	return rm, nil
+}
+
+func buildMetrics(conf *LayerServiceConfig) (Metrics, error) {
+	switch backend := metricsBackend(conf); backend {
+	case MetricsBackendStatsd:
+		c, err := statsd.New(conf.StatsdAgentAddress,
+			statsd.WithNamespace(conf.ServiceName),
+			statsd.WithTags([]string{"application:" + conf.ServiceName}))
 		if err != nil {
 			return nil, err
 		}
+		return &StatsdMetrics{client: c}, nil
+	case MetricsBackendPrometheus:
+		return newPrometheusMetrics(conf.ServiceName), nil
+	case MetricsBackendNone:
+		return &StatsdMetrics{client: &statsd.NoOpClient{}}, nil
+	default:
+		return nil, fmt.Errorf("unknown metrics_backend %s, expected one of statsd, prometheus, none", backend)
+	}
+}
 
-		client = c
-	} else {
-		client = &statsd.NoOpClient{}
+// reloadableMetrics delegates to the Metrics built from the current config, and rebuilds it
+// when the metrics settings change
+type reloadableMetrics struct {
+	current atomic.Pointer[metricsGeneration]
+	conf    LayerServiceConfig
+	logger  Logger
+}
+
+// metricsGeneration is a Metrics built by reloadableMetrics. Calls hold a read lock while they use it,
+// so that it is only closed once the calls that started before a reload have finished.
+type metricsGeneration struct {
+	metrics Metrics
+	mu      sync.RWMutex
+	retired bool
+}
+
+// use calls report with the current Metrics, moving on to its replacement if it is being retired
+func (rm *reloadableMetrics) use(report func(metrics Metrics) TransformError) TransformError {
+	for {
+		generation := rm.current.Load()
+		generation.mu.RLock()
+		if !generation.retired {
+			defer generation.mu.RUnlock()
+			return report(generation.metrics)
+		}
+		generation.mu.RUnlock()
+	}
+}
+
+// retire waits for the calls that use the generation to finish, and then closes its statsd client
+func (g *metricsGeneration) retire() {
+	g.mu.Lock()
+	g.retired = true
+	g.mu.Unlock()
+	if sm, ok := g.metrics.(*StatsdMetrics); ok {
+		_ = sm.client.Close()
+	}
+}
+
+func (rm *reloadableMetrics) Incr(name string, tags []string, rate int) TransformError {
+	return rm.use(func(metrics Metrics) TransformError { return metrics.Incr(name, tags, rate) })
+}
+
+func (rm *reloadableMetrics) Timing(name string, value time.Duration, tags []string, rate int) TransformError {
+	return rm.use(func(metrics Metrics) TransformError { return metrics.Timing(name, value, tags, rate) })
+}
+
+func (rm *reloadableMetrics) Gauge(name string, value float64, tags []string, rate int) TransformError {
+	return rm.use(func(metrics Metrics) TransformError { return metrics.Gauge(name, value, tags, rate) })
+}
+
+func (rm *reloadableMetrics) ValidateConfiguration(config *Config) error {
+	switch metricsBackend(config.LayerServiceConfig) {
+	case MetricsBackendStatsd, MetricsBackendPrometheus, MetricsBackendNone:
+		return nil
+	default:
+		return fmt.Errorf("unknown metrics_backend %s, expected one of statsd, prometheus, none", config.LayerServiceConfig.MetricsBackend)
+	}
+}
+
+func (rm *reloadableMetrics) UpdateConfiguration(config *Config) TransformError {
+	conf := config.LayerServiceConfig
+	oldBackend, newBackend := metricsBackend(&rm.conf), metricsBackend(conf)
+	if oldBackend == newBackend && rm.conf.StatsdAgentAddress == conf.StatsdAgentAddress {
+		return nil
+	}
+	if oldBackend != newBackend && (oldBackend == MetricsBackendPrometheus || newBackend == MetricsBackendPrometheus) {
+		rm.logger.Warn(fmt.Sprintf("metrics_backend changed from %s to %s, restart required to take effect", oldBackend, newBackend))
+		return nil
 	}
 
-	return &StatsdMetrics{client: client}, nil
+	next, err := buildMetrics(conf)
+	if err != nil {
+		return Err(err, LayerErrorBadParameter)
+	}
+	previous := rm.current.Swap(&metricsGeneration{metrics: next})
+	rm.conf = *conf
+	previous.retire()
+	rm.logger.Info("Metrics reconfigured", "backend", newBackend)
+	return nil
+}
+
+// prometheusMetricsOf returns the PrometheusMetrics behind m, or nil if m is not backed by prometheus
+func prometheusMetricsOf(m Metrics) *PrometheusMetrics {
+	if rm, ok := m.(*reloadableMetrics); ok {
+		m = rm.current.Load().metrics
+	}
+	pm, _ := m.(*PrometheusMetrics)
+	return pm
 }
 
 type logger struct {
-	log zerolog.Logger
+	log    zerolog.Logger
+	output *logOutput
+	levels *logLevels
+}
+
+// logLevels is the configured log_level and the level set through the admin api, shared by a logger and
+// every logger derived from it with With
+type logLevels struct {
+	mu         sync.Mutex
+	configured zerolog.Level
+	override   *zerolog.Level
+}
+
+// apply sets the global level to the override, if there is one, and to the configured level otherwise
+func (ll *logLevels) apply() {
+	if ll.override != nil {
+		zerolog.SetGlobalLevel(*ll.override)
+	} else {
+		zerolog.SetGlobalLevel(ll.configured)
+	}
+}
+
+func (ll *logLevels) setConfigured(level zerolog.Level) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	ll.configured = level
+	ll.apply()
+}
+
+func (ll *logLevels) setOverride(level *zerolog.Level) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	ll.override = level
+	ll.apply()
+}
+
+// logOutput is the writer shared by a logger and every logger derived from it with With, so that
+// the log format can be switched at runtime
+type logOutput struct {
+	mu     sync.RWMutex
+	out    io.Writer
+	writer io.Writer
+}
+
+func (o *logOutput) Write(p []byte) (int, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.writer.Write(p)
+}
+
+func (o *logOutput) setFormat(format string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if format == "text" {
+		o.writer = zerolog.ConsoleWriter{Out: o.out, TimeFormat: time.RFC3339}
+	} else {
+		o.writer = o.out
+	}
 }
 
 func (l *logger) With(name string, value string) Logger {
 	subLogger := l.log.With().Str(name, value).Logger()
-	return &logger{subLogger}
+	return &logger{subLogger, l.output, l.levels}
+}
+
+// UpdateConfiguration applies changes to log_level and log_format. A level set with OverrideLevel stays in
+// effect until it is cleared.
+func (l *logger) UpdateConfiguration(config *Config) TransformError {
+	l.levels.setConfigured(logLevel(config.LayerServiceConfig.LogLevel))
+	l.output.setFormat(config.LayerServiceConfig.LogFormat)
+	return nil
+}
+
+func (l *logger) OverrideLevel(level string) {
+	override := logLevel(level)
+	l.levels.setOverride(&override)
+}
+
+func (l *logger) ClearLevelOverride() {
+	l.levels.setOverride(nil)
 }
 
 func (l *logger) Warn(message string, args ...any) {
@@ -90,22 +325,30 @@ func (l *logger) Debug(message string, args ...any) {
 	l.log.Debug().Fields(args).Msg(message)
 }
 
-func NewLogger(serviceName string, format string, level string) Logger {
-	var slevel zerolog.Level
+func logLevel(level string) zerolog.Level {
 	switch strings.ToLower(level) {
 	case "debug":
-		slevel = zerolog.DebugLevel
+		return zerolog.DebugLevel
 	case "info":
-		slevel = zerolog.InfoLevel
+		return zerolog.InfoLevel
 	case "warn":
-		slevel = zerolog.WarnLevel
+		return zerolog.WarnLevel
 	case "error":
-		slevel = zerolog.ErrorLevel
+		return zerolog.ErrorLevel
 	default:
-		slevel = zerolog.InfoLevel
+		return zerolog.InfoLevel
 	}
+}
+
+func NewLogger(serviceName string, format string, level string) Logger {
+	return newLogger(serviceName, format, level, os.Stdout)
+}
+
+// newLogger is NewLogger writing to out
+func newLogger(serviceName string, format string, level string, out io.Writer) Logger {
 	// Default level for this example is info, unless debug flag is present
-	zerolog.SetGlobalLevel(slevel)
+	levels := &logLevels{configured: logLevel(level)}
+	levels.apply()
 	zerolog.TimestampFieldName = "ts"
 	zerolog.MessageFieldName = "msg"
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnixMs
@@ -127,16 +370,14 @@ func NewLogger(serviceName string, format string, level string) Logger {
 		return file + ":" + strconv.Itoa(line)
 	}
 
-	base := zerolog.New(os.Stdout)
-	if format == "text" {
-		base = base.Output(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339})
-	}
-	log := base.With().
+	output := &logOutput{out: out}
+	output.setFormat(format)
+	log := zerolog.New(output).With().
 		Timestamp().
 		Caller().
 		Str("go.version", runtime.Version()).
 		Str("service", serviceName).
 		Logger()
 
-	return &logger{log}
+	return &logger{log, output, levels}
 }
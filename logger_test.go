@@ -0,0 +1,98 @@
+package common_http_transform
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/rs/zerolog"
+)
+
+func TestLoggerUpdateConfiguration(t *testing.T) {
+	l := NewLogger("test", "json", "error").(*logger)
+	defer zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+
+	config, _ := readConfig(strings.NewReader(`{"layer_config": {"log_level": "debug", "log_format": "text"}}`))
+	if err := l.UpdateConfiguration(config); err != nil {
+		t.Fatal(err)
+	}
+	if zerolog.GlobalLevel() != zerolog.DebugLevel {
+		t.Errorf("expected debug level after update, got %s", zerolog.GlobalLevel())
+	}
+	if _, ok := l.output.writer.(zerolog.ConsoleWriter); !ok {
+		t.Errorf("expected text output after update, got %T", l.output.writer)
+	}
+}
+
+func TestReloadableMetricsUpdateConfiguration(t *testing.T) {
+	config, _ := readConfig(strings.NewReader(`{"layer_config": {"service_name": "test"}}`))
+	m, err := newMetrics(config, NewLogger("test", "json", "error"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm := m.(*reloadableMetrics)
+
+	config, _ = readConfig(strings.NewReader(`{"layer_config": {"service_name": "test", "metrics_backend": "graphite"}}`))
+	if err := rm.ValidateConfiguration(config); err == nil {
+		t.Error("expected unknown metrics backend to be rejected")
+	}
+
+	config, _ = readConfig(strings.NewReader(`{"layer_config": {"service_name": "test", "metrics_backend": "prometheus"}}`))
+	if err := rm.UpdateConfiguration(config); err != nil {
+		t.Fatal(err)
+	}
+	if prometheusMetricsOf(rm) != nil {
+		t.Error("expected switch to prometheus to require a restart")
+	}
+}
+
+// blockingStatsdClient blocks Incr until released, and records when it is closed
+type blockingStatsdClient struct {
+	statsd.NoOpClient
+	started chan struct{}
+	release chan struct{}
+	closed  chan struct{}
+}
+
+func (c *blockingStatsdClient) Incr(_ string, _ []string, _ float64) error {
+	close(c.started)
+	<-c.release
+	return nil
+}
+
+func (c *blockingStatsdClient) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestReloadableMetricsClosesClientAfterInFlightCalls(t *testing.T) {
+	client := &blockingStatsdClient{started: make(chan struct{}), release: make(chan struct{}), closed: make(chan struct{})}
+	rm := &reloadableMetrics{
+		logger: NewLogger("test", "json", "error"),
+		conf:   LayerServiceConfig{ServiceName: "test", StatsdEnabled: true, StatsdAgentAddress: "127.0.0.1:8125"},
+	}
+	rm.current.Store(&metricsGeneration{metrics: &StatsdMetrics{client: client}})
+	go func() { _ = rm.Incr("requests", nil, 1) }()
+	<-client.started
+
+	config, _ := readConfig(strings.NewReader(`{"layer_config": {"service_name": "test", "statsd_enabled": true, "statsd_agent_address": "127.0.0.1:8126"}}`))
+	updated := make(chan TransformError)
+	go func() { updated <- rm.UpdateConfiguration(config) }()
+	defer func() { _ = rm.current.Load().metrics.(*StatsdMetrics).client.Close() }()
+
+	select {
+	case <-client.closed:
+		t.Fatal("expected the statsd client not to be closed while a call is using it")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(client.release)
+	if err := <-updated; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-client.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the statsd client to be closed once the call has finished")
+	}
+}
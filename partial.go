@@ -0,0 +1,187 @@
+package common_http_transform
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+const (
+	// HeaderFailedEntityCount is the response trailer carrying the number of entities that failed
+	HeaderFailedEntityCount = "X-Transform-Failed-Count"
+	// HeaderFailedEntities is the response trailer carrying a json array of failed entity ids and errors
+	HeaderFailedEntities = "X-Transform-Failures"
+
+	// maxReportedFailures caps the failures listed in the trailer, the count trailer is always exact
+	maxReportedFailures = 100
+
+	// defaultMaxFailureRatio is the share of failed entities a batch may have when max_failure_ratio is not set
+	defaultMaxFailureRatio = 0.1
+)
+
+// EntityFailure records an entity that could not be transformed
+type EntityFailure struct {
+	Entity *egdm.Entity
+	Err    error
+}
+
+// PartialFailure is returned from Transform, together with the collection of successfully transformed
+// entities, to report that some entities of the batch failed. When partial_failure_enabled is set in
+// layer_config the successful entities are still returned to the caller, otherwise the batch fails as a whole.
+func PartialFailure(failures ...EntityFailure) TransformError {
+	if len(failures) == 0 {
+		return nil
+	}
+	return &partialFailureError{failures: failures}
+}
+
+type partialFailureError struct {
+	failures []EntityFailure
+}
+
+func (p *partialFailureError) Error() string {
+	msgs := make([]string, 0, len(p.failures))
+	for _, f := range p.failures {
+		msgs = append(msgs, entityError{id: f.Entity.ID, err: f.Err}.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (p *partialFailureError) Underlying() error {
+	errs := make([]error, 0, len(p.failures))
+	for _, f := range p.failures {
+		errs = append(errs, f.Err)
+	}
+	return errors.Join(errs...)
+}
+
+// Type is the type of the first failure that carries one, defaulting to LayerErrorInternal
+func (p *partialFailureError) Type() LayerErrorType {
+	for _, f := range p.failures {
+		var te TransformError
+		if errors.As(f.Err, &te) {
+			return te.Type()
+		}
+	}
+	return LayerErrorInternal
+}
+
+func (p *partialFailureError) toHTTPError() *echo.HTTPError {
+	return transformError{err: p, errType: p.Type()}.toHTTPError()
+}
+
+/******************************************************************************/
+
+// partialFailurePolicy decides whether a batch with failed entities is still accepted,
+// and reports the failures through metrics, trailers and the dead letter file
+type partialFailurePolicy struct {
+	maxFailureRatio float64
+	deadLetterFile  string
+	mu              sync.Mutex
+	logger          Logger
+	metrics         Metrics
+}
+
+func newPartialFailurePolicy(conf *LayerServiceConfig, logger Logger, metrics Metrics) (*partialFailurePolicy, error) {
+	if !conf.PartialFailureEnabled {
+		return nil, nil
+	}
+	ratio := defaultMaxFailureRatio
+	if conf.MaxFailureRatio != nil {
+		if *conf.MaxFailureRatio < 0 || *conf.MaxFailureRatio > 1 {
+			return nil, fmt.Errorf("invalid max_failure_ratio %v, must be between 0 and 1", *conf.MaxFailureRatio)
+		}
+		ratio = *conf.MaxFailureRatio
+	}
+	return &partialFailurePolicy{
+		maxFailureRatio: ratio,
+		deadLetterFile:  conf.DeadLetterFile,
+		logger:          logger,
+		metrics:         metrics,
+	}, nil
+}
+
+// declareTrailers must be called before the response status is written
+func (p *partialFailurePolicy) declareTrailers(c echo.Context) {
+	c.Response().Header().Add("Trailer", HeaderFailedEntityCount)
+	c.Response().Header().Add("Trailer", HeaderFailedEntities)
+}
+
+// accept records the failures and returns an error if they exceed the max failure ratio for the batch
+func (p *partialFailurePolicy) accept(c echo.Context, total int, failures []EntityFailure) TransformError {
+	if len(failures) == 0 {
+		return nil
+	}
+	tags := []string{"url:" + strings.ToLower(c.Request().URL.Path)}
+	_ = p.metrics.Gauge("transform.entity.failed", float64(len(failures)), tags, 1)
+	p.writeDeadLetters(c, failures)
+
+	ratio := float64(len(failures)) / float64(total)
+	if total == 0 || ratio > p.maxFailureRatio {
+		_ = p.metrics.Incr("transform.batch.rejected", tags, 1)
+		pf := &partialFailureError{failures: failures}
+		return Errorf(pf.Type(), "%d of %d entities failed, exceeding max failure ratio %v: %s",
+			len(failures), total, p.maxFailureRatio, pf.Error())
+	}
+
+	p.logger.Warn(fmt.Sprintf("%d of %d entities failed, returning partial result", len(failures), total))
+	return nil
+}
+
+// writeTrailers sets the failure trailers, must be called after the response body is written
+func (p *partialFailurePolicy) writeTrailers(c echo.Context, failures []EntityFailure) {
+	type reported struct {
+		ID    string `json:"id"`
+		Error string `json:"error"`
+	}
+	list := make([]reported, 0, len(failures))
+	for i, f := range failures {
+		if i == maxReportedFailures {
+			break
+		}
+		list = append(list, reported{ID: f.Entity.ID, Error: f.Err.Error()})
+	}
+	body, _ := json.Marshal(list)
+	c.Response().Header().Set(HeaderFailedEntityCount, strconv.Itoa(len(failures)))
+	c.Response().Header().Set(HeaderFailedEntities, string(body))
+}
+
+// writeDeadLetters appends the failed entities as json lines to the configured dead letter file
+func (p *partialFailurePolicy) writeDeadLetters(c echo.Context, failures []EntityFailure) {
+	if p.deadLetterFile == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, err := os.OpenFile(p.deadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		p.logger.Error("Failed to open dead letter file", "error", err.Error())
+		return
+	}
+	defer f.Close()
+
+	requestID := c.Response().Header().Get(echo.HeaderXRequestID)
+	encoder := json.NewEncoder(f)
+	for _, failure := range failures {
+		err = encoder.Encode(map[string]any{
+			"ts":         time.Now().UnixMilli(),
+			"request_id": requestID,
+			"id":         failure.Entity.ID,
+			"error":      failure.Err.Error(),
+			"entity":     failure.Entity,
+		})
+		if err != nil {
+			p.logger.Error("Failed to write dead letter", "error", err.Error())
+			return
+		}
+	}
+}
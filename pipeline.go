@@ -0,0 +1,174 @@
+package common_http_transform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+// PipelineService runs TransformServices in sequence, each stage transforming the output of the one
+// before it. Stages are run with TransformEntities, so a StreamingTransformService stage is given one
+// entity at a time. Errors are attributed to the stage that returned them. When a stage reports a PartialFailure,
+// its successful entities continue through the pipeline and the failures are reported at the end.
+// Stop, UpdateConfiguration, ValidateConfiguration and CheckHealth are forwarded to every stage.
+type PipelineService struct {
+	stages  []pipelineStage
+	metrics Metrics
+}
+
+type pipelineStage struct {
+	name    string
+	service TransformService
+}
+
+// Pipeline composes the stages into one TransformService. Stages are named by their position, starting
+// at 1, unless named with WithStageNames.
+func Pipeline(stages ...TransformService) *PipelineService {
+	p := &PipelineService{}
+	for i, service := range stages {
+		p.stages = append(p.stages, pipelineStage{name: strconv.Itoa(i + 1), service: service})
+	}
+	return p
+}
+
+// WithStageNames names the stages in order, for errors and the stage tag of the metrics
+func (p *PipelineService) WithStageNames(names ...string) *PipelineService {
+	for i := 0; i < len(names) && i < len(p.stages); i++ {
+		p.stages[i].name = names[i]
+	}
+	return p
+}
+
+// WithMetrics reports the time, the entities in and out, and the errors of every stage to the given
+// metrics. A pipeline returned by a service factory reports to the metrics of the ServiceRunner by default.
+func (p *PipelineService) WithMetrics(metrics Metrics) *PipelineService {
+	p.metrics = metrics
+	return p
+}
+
+// defaultMetricsUser is implemented by PipelineService, and by services that embed it
+type defaultMetricsUser interface {
+	useDefaultMetrics(metrics Metrics)
+}
+
+// useDefaultMetrics gives a pipeline returned by a service factory the metrics of the ServiceRunner
+func useDefaultMetrics(service TransformService, metrics Metrics) {
+	if user, ok := service.(defaultMetricsUser); ok {
+		user.useDefaultMetrics(metrics)
+	}
+}
+
+// useDefaultMetrics keeps metrics given with WithMetrics
+func (p *PipelineService) useDefaultMetrics(metrics Metrics) {
+	if p.metrics == nil {
+		p.metrics = metrics
+	}
+}
+
+func (p *PipelineService) Stop(ctx context.Context) error {
+	var errs []error
+	for _, stage := range p.stages {
+		if err := stage.service.Stop(ctx); err != nil {
+			errs = append(errs, stageError{stage: stage.name, err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// UpdateConfiguration passes the config to every stage, stopping at the first stage that rejects it
+func (p *PipelineService) UpdateConfiguration(config *Config) TransformError {
+	for _, stage := range p.stages {
+		if err := stage.service.UpdateConfiguration(config); err != nil {
+			return Err(stageError{stage: stage.name, err: err}, err.Type())
+		}
+	}
+	return nil
+}
+
+func (p *PipelineService) ValidateConfiguration(config *Config) error {
+	for _, stage := range p.stages {
+		if validator, ok := stage.service.(ConfigValidator); ok {
+			if err := validator.ValidateConfiguration(config); err != nil {
+				return stageError{stage: stage.name, err: err}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckHealth returns the checks of every stage, prefixed with the stage name
+func (p *PipelineService) CheckHealth(ctx context.Context) map[string]error {
+	checks := map[string]error{}
+	for _, stage := range p.stages {
+		if checker, ok := stage.service.(HealthChecker); ok {
+			for name, err := range checker.CheckHealth(ctx) {
+				checks[stage.name+"."+name] = err
+			}
+		}
+	}
+	return checks
+}
+
+func (p *PipelineService) Transform(entityCollection *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	return p.transformWithContext(context.Background(), entityCollection)
+}
+
+func (p *PipelineService) transformWithContext(ctx context.Context, entityCollection *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	var failures []EntityFailure
+	for _, stage := range p.stages {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, Err(ctxErr, LayerErrorInternal)
+		}
+		result, err := p.runStage(ctx, stage, entityCollection)
+		if err != nil {
+			var pf *partialFailureError
+			if !errors.As(err, &pf) || result == nil {
+				return nil, Err(stageError{stage: stage.name, err: err}, err.Type())
+			}
+			for _, f := range pf.failures {
+				failures = append(failures, EntityFailure{Entity: f.Entity, Err: stageError{stage: stage.name, err: f.Err}})
+			}
+		}
+		if result == nil {
+			return nil, Errorf(LayerErrorInternal, "pipeline stage %s returned no entity collection", stage.name)
+		}
+		entityCollection = result
+	}
+	return entityCollection, PartialFailure(failures...)
+}
+
+func (p *PipelineService) runStage(ctx context.Context, stage pipelineStage, entityCollection *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	start := time.Now()
+	result, err := TransformEntities(ctx, stage.service, entityCollection)
+
+	if p.metrics != nil {
+		tags := []string{"stage:" + stage.name}
+		_ = p.metrics.Timing("transform.pipeline.stage.time", time.Since(start), tags, 1)
+		_ = p.metrics.Gauge("transform.pipeline.stage.entities.in", float64(len(entityCollection.Entities)), tags, 1)
+		if result != nil {
+			_ = p.metrics.Gauge("transform.pipeline.stage.entities.out", float64(len(result.Entities)), tags, 1)
+		}
+		if err != nil {
+			_ = p.metrics.Incr("transform.pipeline.stage.errors", append(tags, "error_type:"+err.Type().String()), 1)
+		}
+	}
+	return result, err
+}
+
+// stageError attributes an error to the pipeline stage that returned it
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e stageError) Error() string {
+	return fmt.Sprintf("pipeline stage %s: %s", e.stage, e.err.Error())
+}
+
+func (e stageError) Unwrap() error {
+	return e.err
+}
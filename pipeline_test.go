@@ -0,0 +1,145 @@
+package common_http_transform
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func parseTestEntities(t *testing.T) *egdm.EntityCollection {
+	t.Helper()
+	nsManager := egdm.NewNamespaceContext()
+	ec, err := egdm.NewEntityParser(nsManager).WithExpandURIs().LoadEntityCollection(strings.NewReader(testEntities))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ec
+}
+
+func TestPipelineRunsStagesInSequence(t *testing.T) {
+	normalise := &testTransform{transform: func(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+		for _, entity := range ec.Entities {
+			entity.Properties["http://example.com/name"] = strings.ToUpper(entity.Properties["http://example.com/name"].(string))
+		}
+		return ec, nil
+	}}
+	filter := &testTransform{transform: func(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+		result := egdm.NewEntityCollection(ec.NamespaceManager)
+		for _, entity := range ec.Entities {
+			if strings.HasPrefix(entity.Properties["http://example.com/name"].(string), "JOHN") {
+				_ = result.AddEntity(entity)
+			}
+		}
+		return result, nil
+	}}
+
+	result, err := Pipeline(normalise, filter).Transform(parseTestEntities(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Entities) != 1 || result.Entities[0].Properties["http://example.com/name"] != "JOHN SMITH" {
+		t.Errorf("expected only the normalised John Smith, got %v", result.Entities)
+	}
+}
+
+func TestPipelineAttributesErrorsToStages(t *testing.T) {
+	passThrough := &testTransform{transform: func(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+		return ec, nil
+	}}
+	failing := &testTransform{transform: func(_ *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+		return nil, Errorf(LayerErrorBadParameter, "no postcode")
+	}}
+	metrics := &countingMetrics{counts: map[string]int{}, gauges: map[string]float64{}}
+
+	_, err := Pipeline(passThrough, failing).WithStageNames("normalise", "enrich").WithMetrics(metrics).Transform(parseTestEntities(t))
+	if err == nil || err.Error() != "pipeline stage enrich: no postcode" {
+		t.Fatalf("expected the error of the enrich stage, got %v", err)
+	}
+	if err.Type() != LayerErrorBadParameter {
+		t.Errorf("expected the type of the stage error to be kept, got %s", err.Type())
+	}
+	if metrics.counts["transform.pipeline.stage.errors stage:enrich,error_type:bad_parameter"] != 1 {
+		t.Errorf("expected the error to be counted for the enrich stage, got %v", metrics.counts)
+	}
+	if metrics.gauges["transform.pipeline.stage.entities.out stage:normalise"] != 2 || metrics.gauges["transform.pipeline.stage.entities.in stage:enrich"] != 2 {
+		t.Errorf("expected the entities of the batch to be reported for every stage, got %v", metrics.gauges)
+	}
+
+	partial := &testTransform{transform: func(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+		result := egdm.NewEntityCollection(ec.NamespaceManager)
+		_ = result.AddEntity(ec.Entities[1])
+		return result, PartialFailure(EntityFailure{Entity: ec.Entities[0], Err: errors.New("no postcode")})
+	}}
+	result, err := Pipeline(partial, passThrough).Transform(parseTestEntities(t))
+	if len(result.Entities) != 1 || result.Entities[0].ID != "http://example.com/2" {
+		t.Fatalf("expected the remaining entity to pass through the pipeline, got %v", result)
+	}
+	if err == nil || err.Error() != "entity http://example.com/1: pipeline stage 1: no postcode" {
+		t.Errorf("expected the failure of the first stage, got %v", err)
+	}
+
+	wrapped := &testTransform{transform: func(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+		result, err := partial.Transform(ec)
+		return result, Err(fmt.Errorf("lookup: %w", err), err.Type())
+	}}
+	result, _ = Pipeline(wrapped, passThrough).Transform(parseTestEntities(t))
+	if result == nil || len(result.Entities) != 1 {
+		t.Errorf("expected a wrapped partial failure to keep the remaining entity, got %v", result)
+	}
+}
+
+// wrappedPipeline is a service built around a pipeline
+type wrappedPipeline struct {
+	*PipelineService
+}
+
+func TestPipelineReportsToServiceMetrics(t *testing.T) {
+	passThrough := &testTransform{transform: func(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+		return ec, nil
+	}}
+	for name, pipeline := range map[string]TransformService{
+		"pipeline": Pipeline(passThrough),
+		"wrapped":  &wrappedPipeline{Pipeline(passThrough)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			configFile := writeTestConfig(t, `{"layer_config": {"service_name": "test", "log_level": "error"}}`)
+			metrics := &countingMetrics{counts: map[string]int{}, gauges: map[string]float64{}}
+			runner := NewServiceRunner(func(_ *Config, _ Logger, _ Metrics) (TransformService, error) {
+				return pipeline, nil
+			}).WithConfigLocation(configFile).WithMetrics(metrics)
+			if err := runner.configure(); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = runner.Stop() }()
+
+			if _, err := runner.transformService.Transform(parseTestEntities(t)); err != nil {
+				t.Fatal(err)
+			}
+			if metrics.gauges["transform.pipeline.stage.entities.in stage:1"] != 2 {
+				t.Errorf("expected the pipeline to report to the metrics of the service, got %v", metrics.gauges)
+			}
+		})
+	}
+}
+
+func TestPipelineStreamsStreamingStages(t *testing.T) {
+	streaming := &testStreamingTransform{testTransform: testTransform{transform: func(_ *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+		return nil, Errorf(LayerErrorInternal, "Transform must not be called on a streaming service")
+	}}}
+
+	ec := parseTestEntities(t)
+	ec.SetContinuationToken(&egdm.Continuation{ID: "@continuation", Token: "next-page"})
+	result, err := Pipeline(streaming).Transform(ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streaming.seen != 2 || len(result.Entities) != 2 || result.Entities[0].ID != "http://example.com/2" {
+		t.Errorf("expected StreamEntity to drop the first entity and duplicate the second, got %v", result.Entities)
+	}
+	if result.Continuation == nil || result.Continuation.Token != "next-page" {
+		t.Errorf("expected the continuation to be kept, got %v", result.Continuation)
+	}
+}
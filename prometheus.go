@@ -0,0 +1,165 @@
+package common_http_transform
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var invalidPrometheusChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// PrometheusMetrics implements Metrics with a prometheus registry, served on /metrics.
+// Statsd style tags ("key:value") become labels. The label names of a metric are fixed by
+// its first use; later calls missing a label record it as empty.
+type PrometheusMetrics struct {
+	registry    *prometheus.Registry
+	constLabels prometheus.Labels
+	mu          sync.Mutex
+	counters    map[string]*prometheus.CounterVec
+	histograms  map[string]*prometheus.HistogramVec
+	gauges      map[string]*prometheus.GaugeVec
+	labelNames  map[string][]string
+}
+
+func newPrometheusMetrics(serviceName string) *PrometheusMetrics {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return &PrometheusMetrics{
+		registry:    registry,
+		constLabels: prometheus.Labels{"application": serviceName},
+		counters:    make(map[string]*prometheus.CounterVec),
+		histograms:  make(map[string]*prometheus.HistogramVec),
+		gauges:      make(map[string]*prometheus.GaugeVec),
+		labelNames:  make(map[string][]string),
+	}
+}
+
+// Handler returns the http handler exposing the registry in the prometheus text format
+func (pm *PrometheusMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(pm.registry, promhttp.HandlerOpts{})
+}
+
+func (pm *PrometheusMetrics) Incr(name string, tags []string, _ int) TransformError {
+	name = prometheusName(name) + "_total"
+	labels := tagsToLabels(tags)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	vec, ok := pm.counters[name]
+	if !ok {
+		vec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, ConstLabels: pm.constLabels}, labelKeys(labels))
+		if err := pm.register(name, vec, labels); err != nil {
+			return err
+		}
+		pm.counters[name] = vec
+	}
+	counter, err := vec.GetMetricWith(pm.labelValues(name, labels))
+	if err != nil {
+		return Err(err, LayerErrorInternal)
+	}
+	counter.Inc()
+	return nil
+}
+
+func (pm *PrometheusMetrics) Timing(name string, value time.Duration, tags []string, _ int) TransformError {
+	name = prometheusName(name) + "_seconds"
+	labels := tagsToLabels(tags)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	vec, ok := pm.histograms[name]
+	if !ok {
+		vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, ConstLabels: pm.constLabels}, labelKeys(labels))
+		if err := pm.register(name, vec, labels); err != nil {
+			return err
+		}
+		pm.histograms[name] = vec
+	}
+	histogram, err := vec.GetMetricWith(pm.labelValues(name, labels))
+	if err != nil {
+		return Err(err, LayerErrorInternal)
+	}
+	histogram.Observe(value.Seconds())
+	return nil
+}
+
+func (pm *PrometheusMetrics) Gauge(name string, value float64, tags []string, _ int) TransformError {
+	name = prometheusName(name)
+	labels := tagsToLabels(tags)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	vec, ok := pm.gauges[name]
+	if !ok {
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, ConstLabels: pm.constLabels}, labelKeys(labels))
+		if err := pm.register(name, vec, labels); err != nil {
+			return err
+		}
+		pm.gauges[name] = vec
+	}
+	gauge, err := vec.GetMetricWith(pm.labelValues(name, labels))
+	if err != nil {
+		return Err(err, LayerErrorInternal)
+	}
+	gauge.Set(value)
+	return nil
+}
+
+func (pm *PrometheusMetrics) register(name string, collector prometheus.Collector, labels map[string]string) TransformError {
+	if err := pm.registry.Register(collector); err != nil {
+		return Errorf(LayerErrorInternal, "could not register metric %s: %s", name, err.Error())
+	}
+	pm.labelNames[name] = labelKeys(labels)
+	return nil
+}
+
+// labelValues aligns the given labels with the label names the metric was registered with
+func (pm *PrometheusMetrics) labelValues(name string, labels map[string]string) prometheus.Labels {
+	values := prometheus.Labels{}
+	for _, key := range pm.labelNames[name] {
+		values[key] = labels[key]
+	}
+	return values
+}
+
+// tagsToLabels converts statsd style tags to prometheus labels. A tag without value becomes a label
+// with empty value.
+func tagsToLabels(tags []string) map[string]string {
+	labels := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		key, value, _ := strings.Cut(tag, ":")
+		key = prometheusName(key)
+		if key == "" || key == "application" {
+			continue
+		}
+		labels[key] = value
+	}
+	return labels
+}
+
+func labelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func prometheusName(name string) string {
+	name = invalidPrometheusChars.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
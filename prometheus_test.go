@@ -0,0 +1,74 @@
+package common_http_transform
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	pm := newPrometheusMetrics("test")
+	if err := pm.Incr("entities.enriched", []string{"source:weather", "cached"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.Incr("entities.enriched", []string{"source:geo"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.Timing("lookup.time", 250*time.Millisecond, []string{"source:weather"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.Gauge("queue.size", 7, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	pm.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, expected := range []string{
+		`entities_enriched_total{application="test",cached="",source="weather"} 1`,
+		`entities_enriched_total{application="test",cached="",source="geo"} 1`,
+		`lookup_time_seconds_sum{application="test",source="weather"} 0.25`,
+		`queue_size{application="test"} 7`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected %s in scrape output", expected)
+		}
+	}
+}
+
+func TestPrometheusMetricsEndpoint(t *testing.T) {
+	ws := newTestWebServiceWithConfig(t, `{"layer_config": {"service_name": "test", "metrics_backend": "prometheus"}}`,
+		&testTransform{transform: func(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+			return ec, nil
+		}})
+	postTransform(ws, testEntities, nil)
+	ws.e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/transform?attempt=2", strings.NewReader(`{"not": "an array"}`)))
+
+	// scrape twice, so that a request metric for the first scrape would show in the second
+	ws.e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	rec := httptest.NewRecorder()
+	ws.e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `http_count_total{application="test",method="post"`) {
+		t.Errorf("expected http request counter in scrape output, got %s", body)
+	}
+	for _, expected := range []string{
+		`http_count_total{application="test",method="post",status="200",url="/transform"} 1`,
+		`http_count_total{application="test",method="post",status="400",url="/transform"} 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %s in scrape output, got %s", expected, body)
+		}
+	}
+	if strings.Contains(body, `url="/metrics"`) {
+		t.Error("expected /metrics requests to be skipped by request metrics")
+	}
+}
@@ -2,15 +2,11 @@ package main
 
 import (
 	ct "github.com/mimiro-io/common-http-transform"
-	"os"
 )
 
-// main function
+// main function, run with e.g. `serve --config ./config/sample_config.json` or `transform --config ./config/sample_config.json --in entities.json`
 func main() {
-	args := os.Args[1:]
-	configFile := args[0]
-	serviceRunner := ct.NewServiceRunner(NewSampleTransform)
-	serviceRunner.WithConfigLocation(configFile)
-	serviceRunner.WithEnrichConfig(EnrichConfig)
-	serviceRunner.StartAndWait()
+	ct.NewServiceRunner(NewSampleTransform).
+		WithEnrichConfig(EnrichConfig).
+		RunCLI()
 }
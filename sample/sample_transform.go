@@ -4,7 +4,6 @@ import (
 	"context"
 	ct "github.com/mimiro-io/common-http-transform"
 	egdm "github.com/mimiro-io/entity-graph-data-model"
-	"sync"
 )
 
 // EnrichConfig is a function that can be used to enrich the config by reading additional files or environment variables
@@ -20,89 +19,45 @@ func EnrichConfig(config *ct.Config) error {
 
 /*********************************************************************************************************************/
 
-// SampleTransform is a sample implementation of the Transform interface
+// SampleConfig is the typed form of external_config, bound with ct.BindExternalConfig
+type SampleConfig struct {
+	InMemory bool `config:"in_memory" default:"false"`
+}
+
+// SampleTransform is a sample implementation of the EntityTransformer interface
 type SampleTransform struct {
-	config  *ct.Config
-	logger  ct.Logger
-	metrics ct.Metrics
+	config       *ct.Config
+	sampleConfig SampleConfig
+	logger       ct.Logger
+	metrics      ct.Metrics
 }
 
 // no shutdown required
 func (dl *SampleTransform) Stop(_ context.Context) error { return nil }
 
-func (dl *SampleTransform) Transform(ec *egdm.EntityCollection) (*egdm.EntityCollection, ct.TransformError) {
-	result, err := processEntitiesConcurrently(ec.Entities, 10, processEntity)
-	if err != nil {
-		return nil, ct.Err(err, 1)
-	}
-	return &egdm.EntityCollection{Entities: result, NamespaceManager: ec.NamespaceManager}, nil
-}
-
-type Result struct {
-	Index  int
-	Entity *egdm.Entity
-	Error  error
-}
-
-func processEntitiesConcurrently(entities []*egdm.Entity, concurrency int, handler func(entity *egdm.Entity) (*egdm.Entity, error)) ([]*egdm.Entity, error) {
-	var wg sync.WaitGroup
-	results := make([]Result, len(entities))
-	resultsChan := make(chan Result, len(entities))
-
-	// Number of goroutines to use
-	itemsPerGoroutine := (len(entities) + concurrency - 1) / concurrency
-
-	for i := 0; i < concurrency; i++ {
-		start := i * itemsPerGoroutine
-		end := start + itemsPerGoroutine
-		if end > len(entities) {
-			end = len(entities)
-		}
-
-		wg.Add(1)
-		go func(start, end, index int) {
-			defer wg.Done()
-			for j := start; j < end; j++ {
-				result, err := handler(entities[j])
-				resultsChan <- Result{Index: j, Entity: result, Error: err}
-			}
-		}(start, end, i)
-	}
-
-	go func() {
-		wg.Wait()
-		close(resultsChan)
-	}()
-
-	for result := range resultsChan {
-		if result.Error != nil {
-			return nil, result.Error
-		}
-		results[result.Index] = result
-	}
-
-	// filter out non nil
-	finalResults := make([]*egdm.Entity, 0)
-	for _, result := range results {
-		if result.Entity != nil {
-			finalResults = append(finalResults, result.Entity)
-		}
-	}
-
-	return finalResults, nil
-}
-
-func processEntity(entity *egdm.Entity) (*egdm.Entity, error) {
-	return entity, nil
+// TransformEntity is called for every entity in a batch. Return no entities to drop the input, or several to expand it.
+func (dl *SampleTransform) TransformEntity(_ context.Context, entity *egdm.Entity) ([]*egdm.Entity, error) {
+	return []*egdm.Entity{entity}, nil
 }
 
 // NewSampleTransform is a factory function that creates a new instance of the sample transform
 func NewSampleTransform(conf *ct.Config, logger ct.Logger, metrics ct.Metrics) (ct.TransformService, error) {
-	sampleTransform := &SampleTransform{config: conf, logger: logger, metrics: metrics}
-	return sampleTransform, nil
+	sampleConfig, err := ct.BindExternalConfig[SampleConfig](conf)
+	if err != nil {
+		return nil, err
+	}
+	sampleTransform := &SampleTransform{config: conf, sampleConfig: sampleConfig, logger: logger, metrics: metrics}
+	return ct.NewEntityTransformService(sampleTransform).WithConcurrency(10), nil
 }
 
+// UpdateConfiguration binds the changed external_config again, rejecting the change if it does not validate
 func (dl *SampleTransform) UpdateConfiguration(config *ct.Config) ct.TransformError {
+	sampleConfig, err := ct.BindExternalConfig[SampleConfig](config)
+	if err != nil {
+		return ct.Err(err, ct.LayerErrorBadParameter)
+	}
+	dl.config = config
+	dl.sampleConfig = sampleConfig
 	return nil
 }
 
@@ -2,9 +2,13 @@ package common_http_transform
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/signal"
-	"sync"
+	"regexp"
 	"syscall"
 	"time"
 )
@@ -19,13 +23,103 @@ func (serviceRunner *ServiceRunner) WithConfigLocation(configLocation string) *S
 	return serviceRunner
 }
 
+// WithLogger makes the service log to logger instead of the logger configured by log_level and log_format
+func (serviceRunner *ServiceRunner) WithLogger(logger Logger) *ServiceRunner {
+	serviceRunner.logger = logger
+	return serviceRunner
+}
+
+// WithMetrics makes the service report to metrics instead of the configured metrics backend
+func (serviceRunner *ServiceRunner) WithMetrics(metrics Metrics) *ServiceRunner {
+	serviceRunner.metrics = metrics
+	return serviceRunner
+}
+
+// WithTransform serves the TransformService created by newTransformService on POST /transform/<name>,
+// next to the default service on /transform. The factory gets a logger with the field transform=<name>
+// and metrics tagged transform:<name>, while the metrics of the default service are tagged
+// transform:default. Config updates are delivered to every transform service. Names may contain letters,
+// digits, '.', '_' and '-'.
+func (serviceRunner *ServiceRunner) WithTransform(name string, newTransformService func(config *Config, logger Logger, metrics Metrics) (TransformService, error)) *ServiceRunner {
+	serviceRunner.namedTransforms = append(serviceRunner.namedTransforms, &namedTransform{name: name, createService: newTransformService})
+	return serviceRunner
+}
+
+// ConfigBinder checks and applies a part of the config, see ConfigBinding
+type ConfigBinder interface {
+	ConfigValidator
+	UpdateConfiguration(config *Config) TransformError
+}
+
+// WithConfigBinding binds the config when the service is configured, before the transform services are
+// created, and again in the validation step of every config reload, e.g. with a ConfigBinding. A config
+// that fails to bind stops the service from starting, or is rejected on reload.
+func (serviceRunner *ServiceRunner) WithConfigBinding(binding ConfigBinder) *ServiceRunner {
+	serviceRunner.bindings = append(serviceRunner.bindings, binding)
+	return serviceRunner
+}
+
 func NewServiceRunner(newTransformService func(config *Config, logger Logger, metrics Metrics) (TransformService, error)) *ServiceRunner {
 	runner := &ServiceRunner{}
 	runner.createService = newTransformService
+	runner.shutdownTimeout = defaultShutdownTimeout
 	return runner
 }
 
-func (serviceRunner *ServiceRunner) configure() {
+// Errors returned by ServiceRunner.Start, wrapping the underlying cause. Use errors.Is to tell them apart.
+var (
+	ErrConfigLoad     = errors.New("failed to load config")
+	ErrConfigEnrich   = errors.New("failed to enrich config")
+	ErrMetrics        = errors.New("failed to set up metrics")
+	ErrServiceFactory = errors.New("failed to create transform service")
+	ErrConfigUpdater  = errors.New("failed to start config updater")
+	ErrWebService     = errors.New("failed to set up web service")
+	ErrAdmin          = errors.New("failed to set up admin api")
+	ErrListen         = errors.New("failed to listen")
+)
+
+// defaultShutdownTimeout is used when shutdown_timeout is not set
+const defaultShutdownTimeout = 30 * time.Second
+
+// defaultTransformName tags the metrics of the service on /transform when named transforms are registered
+const defaultTransformName = "default"
+
+var validTransformName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// namedTransform is a TransformService registered with WithTransform
+type namedTransform struct {
+	name          string
+	createService func(config *Config, logger Logger, metrics Metrics) (TransformService, error)
+	service       TransformService
+	logger        Logger
+}
+
+// validateTransformNames checks that the names of the transforms can be used in a route and are unique
+func (serviceRunner *ServiceRunner) validateTransformNames() error {
+	seen := map[string]bool{defaultTransformName: true}
+	for _, named := range serviceRunner.namedTransforms {
+		if !validTransformName.MatchString(named.name) {
+			return fmt.Errorf("invalid transform name %q", named.name)
+		}
+		if seen[named.name] {
+			return fmt.Errorf("transform name %q is already in use", named.name)
+		}
+		seen[named.name] = true
+	}
+	return nil
+}
+
+func (serviceRunner *ServiceRunner) namedTransform(name string) *namedTransform {
+	for _, named := range serviceRunner.namedTransforms {
+		if named.name == name {
+			return named
+		}
+	}
+	return nil
+}
+
+// prepareConfig locates, loads and enriches the config, and sets up the logger and metrics from it
+func (serviceRunner *ServiceRunner) prepareConfig() (*Config, error) {
 	if serviceRunner.configLocation == "" {
 		configPath, found := os.LookupEnv("DATALAYER_CONFIG_PATH")
 		if found {
@@ -37,88 +131,191 @@ func (serviceRunner *ServiceRunner) configure() {
 
 	config, err := loadConfig(serviceRunner.configLocation)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %w", ErrConfigLoad, err)
 	}
 
 	// enrich config specific for layer
 	if serviceRunner.enrichConfig != nil {
 		err = serviceRunner.enrichConfig(config)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("%w: %w", ErrConfigEnrich, err)
 		}
 	}
 
-	// initialise logger
-	logger := NewLogger(
-		config.LayerServiceConfig.ServiceName,
-		config.LayerServiceConfig.LogFormat,
-		config.LayerServiceConfig.LogLevel,
-	)
-	serviceRunner.logger = logger
+	if config.LayerServiceConfig.ShutdownTimeout != "" {
+		serviceRunner.shutdownTimeout, err = asDuration(config.LayerServiceConfig.ShutdownTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid shutdown_timeout: %w", ErrConfigLoad, err)
+		}
+	}
 
-	metrics, err := newMetrics(config)
-	if err != nil {
-		panic(err)
+	// initialise logger, unless one was given with WithLogger
+	if serviceRunner.logger == nil {
+		logOutput := serviceRunner.logOutput
+		if logOutput == nil {
+			logOutput = os.Stdout
+		}
+		serviceRunner.logger = newLogger(
+			config.LayerServiceConfig.ServiceName,
+			config.LayerServiceConfig.LogFormat,
+			config.LayerServiceConfig.LogLevel,
+			logOutput,
+		)
+	}
+
+	if serviceRunner.metrics == nil {
+		serviceRunner.metrics, err = newMetrics(config, serviceRunner.logger)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrMetrics, err)
+		}
 	}
 
-	serviceRunner.transformService, err = serviceRunner.createService(config, logger, metrics)
+	return config, nil
+}
+
+func (serviceRunner *ServiceRunner) configure() error {
+	config, err := serviceRunner.prepareConfig()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	logger, metrics := serviceRunner.logger, serviceRunner.metrics
+	if err = serviceRunner.validateTransformNames(); err != nil {
+		return fmt.Errorf("%w: %w", ErrServiceFactory, err)
+	}
+
+	for _, binding := range serviceRunner.bindings {
+		if err = binding.UpdateConfiguration(config); err != nil {
+			return fmt.Errorf("%w: %w", ErrConfigLoad, err)
+		}
 	}
 
-	// create and start config updater
-	serviceRunner.configUpdater, err = newConfigUpdater(config, serviceRunner.enrichConfig, logger, serviceRunner.transformService)
+	serviceMetrics := metrics
+	if len(serviceRunner.namedTransforms) > 0 {
+		serviceMetrics = withTags(metrics, "transform:"+defaultTransformName)
+	}
+	serviceRunner.transformService, err = serviceRunner.createService(config, logger, serviceMetrics)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("%w: %w", ErrServiceFactory, err)
+	}
+	useDefaultMetrics(serviceRunner.transformService, serviceMetrics)
+	serviceRunner.stoppable = append(serviceRunner.stoppable, serviceRunner.transformService)
+	for _, named := range serviceRunner.namedTransforms {
+		named.logger = logger.With("transform", named.name)
+		namedMetrics := withTags(metrics, "transform:"+named.name)
+		named.service, err = named.createService(config, named.logger, namedMetrics)
+		if err != nil {
+			return fmt.Errorf("%w: transform %s: %w", ErrServiceFactory, named.name, err)
+		}
+		useDefaultMetrics(named.service, namedMetrics)
+		serviceRunner.stoppable = append(serviceRunner.stoppable, named.service)
 	}
 
 	// create web service hook up with the service core
 	serviceRunner.webService, err = newTransformService(config, logger, metrics, serviceRunner.transformService)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("%w: %w", ErrWebService, err)
+	}
+	// the web service drains before anything else is stopped, so that no transform is running when
+	// the transform service stops
+	serviceRunner.stoppable = append([]Stoppable{serviceRunner.webService}, serviceRunner.stoppable...)
+	for _, named := range serviceRunner.namedTransforms {
+		serviceRunner.webService.addTransform(named.name, named.service, named.logger)
+	}
+
+	// admin api, if enabled, on the web service or its own port
+	serviceRunner.admin, err = newAdminService(config, logger, metrics, serviceRunner.webService)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrAdmin, err)
 	}
 
-	serviceRunner.stoppable = append(
-		serviceRunner.stoppable,
-		serviceRunner.transformService,
-		serviceRunner.configUpdater,
-		serviceRunner.webService)
+	// create and start config updater, the service core is notified last so that it sees
+	// the log, metrics and web settings already applied
+	var listeners []configListener
+	for _, candidate := range []any{logger, metrics} {
+		if listener, ok := candidate.(configListener); ok {
+			listeners = append(listeners, listener)
+		}
+	}
+	listeners = append(listeners, serviceRunner.webService)
+	if serviceRunner.admin != nil {
+		listeners = append(listeners, serviceRunner.admin)
+	}
+	for _, binding := range serviceRunner.bindings {
+		listeners = append(listeners, binding)
+	}
+	listeners = append(listeners, serviceRunner.transformService)
+	for _, named := range serviceRunner.namedTransforms {
+		listeners = append(listeners, named.service)
+	}
+	serviceRunner.configUpdater, err = newConfigUpdater(config, serviceRunner.enrichConfig, logger, metrics, listeners...)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrConfigUpdater, err)
+	}
+	serviceRunner.stoppable = append(serviceRunner.stoppable, serviceRunner.configUpdater)
+	serviceRunner.webService.health.configStatus = serviceRunner.configUpdater.lastReloadError
+	if serviceRunner.admin != nil {
+		serviceRunner.admin.updater = serviceRunner.configUpdater
+		serviceRunner.stoppable = append(serviceRunner.stoppable, serviceRunner.admin)
+	}
+
+	return nil
 }
 
 type ServiceRunner struct {
 	logger           Logger
+	logOutput        io.Writer
+	metrics          Metrics
 	enrichConfig     func(config *Config) error
+	bindings         []ConfigBinder
 	webService       *transformWebService
+	admin            *adminService
 	configUpdater    *configUpdater
 	createService    func(config *Config, logger Logger, metrics Metrics) (TransformService, error)
+	namedTransforms  []*namedTransform
 	configLocation   string
 	transformService TransformService
 	stoppable        []Stoppable
+	shutdownTimeout  time.Duration
 }
 
 func (serviceRunner *ServiceRunner) TransformService() TransformService {
 	return serviceRunner.transformService
 }
 
+// Addr returns the address the http server listens on, or nil if the service is not started. This is
+// useful with port 0, where the port is picked when the service starts.
+func (serviceRunner *ServiceRunner) Addr() net.Addr {
+	if serviceRunner.webService == nil || serviceRunner.webService.e.Listener == nil {
+		return nil
+	}
+	return serviceRunner.webService.e.Listener.Addr()
+}
+
+// Start configures the service and starts the http server. It returns once the server is listening,
+// or with an error wrapping one of ErrConfigLoad, ErrConfigEnrich, ErrMetrics, ErrServiceFactory,
+// ErrConfigUpdater, ErrWebService, ErrAdmin or ErrListen. Anything started before the failure is stopped again.
 func (serviceRunner *ServiceRunner) Start() error {
 	// configure the service
-	serviceRunner.configure()
-
-	// start the service
-	err := serviceRunner.webService.Start()
+	err := serviceRunner.configure()
+	if err == nil {
+		// start the service
+		err = serviceRunner.webService.Start()
+	}
+	if err == nil && serviceRunner.admin != nil {
+		err = serviceRunner.admin.Start()
+	}
 	if err != nil {
+		_ = serviceRunner.Stop()
 		return err
 	}
 
 	return nil
 }
 
+// StartAndWait starts the service and blocks until SIGINT or SIGTERM is received. It panics if the
+// service cannot be started.
 func (serviceRunner *ServiceRunner) StartAndWait() {
-	// configure the service
-	serviceRunner.configure()
-
-	// start the service
-	err := serviceRunner.webService.Start()
+	err := serviceRunner.Start()
 	if err != nil {
 		panic(err)
 	}
@@ -127,47 +324,38 @@ func (serviceRunner *ServiceRunner) StartAndWait() {
 	serviceRunner.andWait()
 }
 
+// Stop shuts the service down in order: the web service stops being ready, stops accepting requests and
+// waits up to shutdown_timeout for in-flight transforms, then the transform service, the config updater
+// and the admin api are stopped, each stage again within shutdown_timeout.
 func (serviceRunner *ServiceRunner) Stop() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	var errs []error
 	for _, stoppable := range serviceRunner.stoppable {
-		err := stoppable.Stop(ctx)
-		if err != nil {
-			return err
+		ctx, cancel := context.WithTimeout(context.Background(), serviceRunner.shutdownTimeout)
+		if err := stoppable.Stop(ctx); err != nil {
+			errs = append(errs, err)
 		}
+		cancel()
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 func (serviceRunner *ServiceRunner) andWait() {
 	// handle shutdown, this call blocks and keeps the application running
-	waitForStop(serviceRunner.logger, serviceRunner.stoppable...)
+	waitForStop(serviceRunner.logger, serviceRunner.Stop)
 }
 
-//	 waitForStop listens for SIGINT (Ctrl+C) and SIGTERM (graceful docker stop).
-//		It accepts a list of stoppables that will be stopped when a signal is received.
-func waitForStop(logger Logger, stoppable ...Stoppable) {
+// waitForStop listens for SIGINT (Ctrl+C) and SIGTERM (graceful docker stop), then calls stop and exits.
+func waitForStop(logger Logger, stop func() error) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	<-sigChan
 	logger.Info("Data Layer stopping")
 
-	shutdownCtx := context.Background()
-	wg := sync.WaitGroup{}
-	for _, s := range stoppable {
-		s := s
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			err := s.Stop(shutdownCtx)
-			if err != nil {
-				logger.Error("Stopping Data Layer failed: %+v", err)
-				os.Exit(2)
-			}
-		}()
-	}
-	wg.Wait()
+	if err := stop(); err != nil {
+		logger.Error("Stopping Data Layer failed", "error", err.Error())
+		os.Exit(2)
+	}
 	logger.Info("Data Layer stopped")
 	os.Exit(0)
 }
@@ -0,0 +1,159 @@
+package common_http_transform
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+func newTestTransform(_ *Config, _ Logger, _ Metrics) (TransformService, error) {
+	return &testTransform{}, nil
+}
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestServiceRunner_StartErrors(t *testing.T) {
+	err := NewServiceRunner(newTestTransform).WithConfigLocation("./testdata/missing.json").Start()
+	if !errors.Is(err, ErrConfigLoad) {
+		t.Errorf("expected ErrConfigLoad, got %v", err)
+	}
+
+	configFile := writeTestConfig(t, `{"layer_config": {"service_name": "test", "log_level": "error"}}`)
+	err = NewServiceRunner(func(_ *Config, _ Logger, _ Metrics) (TransformService, error) {
+		return nil, errors.New("no credentials")
+	}).WithConfigLocation(configFile).Start()
+	if !errors.Is(err, ErrServiceFactory) {
+		t.Errorf("expected ErrServiceFactory, got %v", err)
+	}
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	configFile = writeTestConfig(t, `{"layer_config": {"service_name": "test", "log_level": "error", "port": `+strconv.Itoa(port)+`}}`)
+	err = NewServiceRunner(newTestTransform).WithConfigLocation(configFile).Start()
+	if !errors.Is(err, ErrListen) {
+		t.Errorf("expected ErrListen, got %v", err)
+	}
+}
+
+func TestServiceRunner_WithTransform(t *testing.T) {
+	configFile := writeTestConfig(t, `{"layer_config": {"service_name": "v1", "log_level": "error", "port": "0", "config_reload_mode": "poll"}}`)
+	received := map[string]Metrics{}
+	newListener := func(name string, suffix string) func(*Config, Logger, Metrics) (TransformService, error) {
+		return func(_ *Config, _ Logger, metrics Metrics) (TransformService, error) {
+			received[name] = metrics
+			return &transactionalListener{testTransform: testTransform{transform: func(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+				for _, entity := range ec.Entities {
+					entity.ID += suffix
+				}
+				return ec, nil
+			}}}, nil
+		}
+	}
+	runner := NewServiceRunner(newListener("default", "")).
+		WithConfigLocation(configFile).
+		WithTransform("upper", newListener("upper", "-upper"))
+	if err := runner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer runner.Stop()
+
+	for path, expected := range map[string]string{"/transform": "http://example.com/1", "/transform/upper": "http://example.com/1-upper"} {
+		resp, err := http.Post("http://"+runner.Addr().String()+path, "application/json", strings.NewReader(testEntities))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"id":"`+expected+`"`) {
+			t.Errorf("expected %s from %s, got %d: %s", expected, path, resp.StatusCode, body)
+		}
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("expected both factories to be called, got %v", received)
+	}
+	for name, metrics := range received {
+		tagged, ok := metrics.(*taggedMetrics)
+		if !ok || strings.Join(tagged.tags, ",") != "transform:"+name {
+			t.Errorf("expected the metrics of %s to be tagged transform:%s, got %v", name, name, metrics)
+		}
+	}
+
+	if err := os.WriteFile(configFile, []byte(`{"layer_config": {"service_name": "v2", "log_level": "error", "port": "0", "config_reload_mode": "poll"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	runner.configUpdater.forceReload()
+	named := runner.namedTransform("upper").service.(*transactionalListener)
+	if strings.Join(named.applied, ",") != "v2" {
+		t.Errorf("expected the config update to be delivered to the named transform, got %v", named.applied)
+	}
+
+	err := NewServiceRunner(newTestTransform).WithConfigLocation(configFile).WithTransform("a/b", newTestTransform).Start()
+	if !errors.Is(err, ErrServiceFactory) {
+		t.Errorf("expected ErrServiceFactory for an invalid name, got %v", err)
+	}
+}
+
+type slowTransform struct {
+	testTransform
+	started  chan struct{}
+	returned atomic.Bool
+	stopped  chan bool
+}
+
+func (s *slowTransform) Transform(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	close(s.started)
+	time.Sleep(1500 * time.Millisecond)
+	s.returned.Store(true)
+	return ec, nil
+}
+
+func (s *slowTransform) Stop(_ context.Context) error {
+	s.stopped <- s.returned.Load()
+	return nil
+}
+
+func TestServiceRunner_StopWaitsForStragglers(t *testing.T) {
+	configFile := writeTestConfig(t, `{"layer_config": {"service_name": "test", "log_level": "error", "port": "0", "shutdown_timeout": "1s"}}`)
+	slow := &slowTransform{started: make(chan struct{}), stopped: make(chan bool, 1)}
+	runner := NewServiceRunner(func(_ *Config, _ Logger, _ Metrics) (TransformService, error) {
+		return slow, nil
+	}).WithConfigLocation(configFile)
+	if err := runner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		resp, err := http.Post("http://"+runner.Addr().String()+"/transform", "application/json", strings.NewReader(testEntities))
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-slow.started
+
+	_ = runner.Stop()
+	if returned := <-slow.stopped; !returned {
+		t.Error("expected the transform service to be stopped after the running transform returned")
+	}
+}
@@ -0,0 +1,95 @@
+package common_http_transform
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+// entityStreamWriter writes entities as an entity graph json array, one entity at a time.
+// The output is identical to egdm.EntityCollection.WriteEntityGraphJSON. Nothing is written to the
+// underlying response before the first entity (or Close), so errors raised before that point can still
+// be reported with a proper status code.
+type entityStreamWriter struct {
+	response   *echo.Response
+	namespaces func() map[string]string
+	started    bool
+	count      int
+
+	// continuation is written after the last entity, if the request carried one
+	continuation *egdm.Continuation
+}
+
+func newEntityStreamWriter(response *echo.Response, namespaces func() map[string]string) *entityStreamWriter {
+	return &entityStreamWriter{response: response, namespaces: namespaces}
+}
+
+func (w *entityStreamWriter) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	w.response.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	w.response.WriteHeader(http.StatusOK)
+
+	context := egdm.NewContext()
+	if w.namespaces != nil {
+		context.Namespaces = w.namespaces()
+	}
+	contextJson, err := json.Marshal(context)
+	if err != nil {
+		return err
+	}
+	return w.write([]byte("[\n"), contextJson)
+}
+
+// Write appends a single entity to the response
+func (w *entityStreamWriter) Write(entity *egdm.Entity) error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	entityJson, err := json.Marshal(entity)
+	if err != nil {
+		return err
+	}
+	w.count++
+	return w.write([]byte(",\n"), entityJson)
+}
+
+// SetContinuationToken sets the continuation that Close writes after the last entity. It matches the
+// continuation callback of egdm.EntityParser.Parse.
+func (w *entityStreamWriter) SetContinuationToken(continuation *egdm.Continuation) {
+	w.continuation = continuation
+}
+
+// Close writes the continuation, if any, terminates the json array and flushes the response
+func (w *entityStreamWriter) Close() error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	if w.continuation != nil {
+		continuationJson, err := json.Marshal(w.continuation)
+		if err != nil {
+			return err
+		}
+		if err = w.write([]byte(", "), continuationJson); err != nil {
+			return err
+		}
+	}
+	if err := w.write([]byte("\n]")); err != nil {
+		return err
+	}
+	w.response.Flush()
+	return nil
+}
+
+func (w *entityStreamWriter) write(chunks ...[]byte) error {
+	for _, chunk := range chunks {
+		if _, err := w.response.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package common_http_transform
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/labstack/echo/v4"
+)
+
+// tlsFiles are the tls settings of layer_config
+type tlsFiles struct {
+	certFile       string
+	keyFile        string
+	clientCAFile   string
+	clientSubjects []string
+}
+
+func tlsFilesOf(conf *LayerServiceConfig) tlsFiles {
+	return tlsFiles{
+		certFile:       conf.TLSCertFile,
+		keyFile:        conf.TLSKeyFile,
+		clientCAFile:   conf.TLSClientCAFile,
+		clientSubjects: conf.TLSClientSubjects,
+	}
+}
+
+func (f tlsFiles) paths() []string {
+	paths := []string{f.certFile, f.keyFile}
+	if f.clientCAFile != "" {
+		paths = append(paths, f.clientCAFile)
+	}
+	return paths
+}
+
+// tlsMaterial is the content of the tls files, compared to skip reloads when nothing changed
+type tlsMaterial struct {
+	cert, key, clientCA []byte
+}
+
+func (m tlsMaterial) equals(other tlsMaterial) bool {
+	return bytes.Equal(m.cert, other.cert) && bytes.Equal(m.key, other.key) && bytes.Equal(m.clientCA, other.clientCA)
+}
+
+// clientCertPolicy is enforced on the transform and admin routes when tls_client_ca_file is set. Client
+// certificates are only verified against the CA during the handshake, if given, so that health probes
+// and metrics scrapes without a certificate are still served.
+type clientCertPolicy struct {
+	required        bool
+	allowedSubjects map[string]bool
+}
+
+func clientCertPolicyOf(files tlsFiles) *clientCertPolicy {
+	policy := &clientCertPolicy{required: files.clientCAFile != ""}
+	if len(files.clientSubjects) > 0 {
+		policy.allowedSubjects = map[string]bool{}
+		for _, subject := range files.clientSubjects {
+			policy.allowedSubjects[subject] = true
+		}
+	}
+	return policy
+}
+
+// tlsServing provides the tls config of the http servers. The certificate, key and client CA bundle are
+// watched like the config file and reloaded when they change, so that rotated certificates are used
+// without a restart. A config change pointing to other files is applied too.
+type tlsServing struct {
+	current  atomic.Pointer[tls.Config]
+	clients  atomic.Pointer[clientCertPolicy]
+	logger   Logger
+	interval time.Duration
+
+	mu       sync.Mutex
+	files    tlsFiles
+	material tlsMaterial
+	watcher  *fsnotify.Watcher
+	ticker   *time.Ticker
+	done     chan struct{}
+}
+
+// newTLSServing returns nil if tls_cert_file is not set
+func newTLSServing(config *Config, logger Logger) (*tlsServing, error) {
+	files := tlsFilesOf(config.LayerServiceConfig)
+	if files.certFile == "" && files.keyFile == "" {
+		if files.clientCAFile != "" {
+			return nil, errors.New("tls_client_ca_file requires tls_cert_file and tls_key_file to be set")
+		}
+		return nil, nil
+	}
+
+	t := &tlsServing{logger: logger, interval: 5 * time.Second}
+	if config.LayerServiceConfig.ConfigRefreshInterval != "" {
+		interval, err := asDuration(config.LayerServiceConfig.ConfigRefreshInterval)
+		if err != nil {
+			return nil, err
+		}
+		t.interval = interval
+	}
+
+	material, tlsConfig, err := loadTLSConfig(files)
+	if err != nil {
+		return nil, err
+	}
+	t.files, t.material = files, material
+	t.current.Store(tlsConfig)
+	t.clients.Store(clientCertPolicyOf(files))
+	t.watch()
+	return t, nil
+}
+
+// clientCertMiddleware rejects requests without a client certificate with 401, and requests with a
+// certificate outside tls_client_subjects with 403
+func (t *tlsServing) clientCertMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		policy := t.clients.Load()
+		if !policy.required {
+			return next(c)
+		}
+		state := c.Request().TLS
+		if state == nil || len(state.VerifiedChains) == 0 {
+			return Errorf(LayerErrorUnauthorized, "client certificate required").toHTTPError()
+		}
+		if policy.allowedSubjects != nil {
+			subject := state.VerifiedChains[0][0].Subject
+			if !policy.allowedSubjects[subject.CommonName] && !policy.allowedSubjects[subject.String()] {
+				return Errorf(LayerErrorForbidden, "client certificate subject %s is not allowed", subject).toHTTPError()
+			}
+		}
+		return next(c)
+	}
+}
+
+// serverConfig is used for the listeners. It hands out the current tls config on every handshake.
+func (t *tlsServing) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.current.Load(), nil
+		},
+	}
+}
+
+func readTLSMaterial(files tlsFiles) (tlsMaterial, error) {
+	var m tlsMaterial
+	var err error
+	if m.cert, err = os.ReadFile(files.certFile); err != nil {
+		return m, fmt.Errorf("failed to read tls_cert_file: %w", err)
+	}
+	if m.key, err = os.ReadFile(files.keyFile); err != nil {
+		return m, fmt.Errorf("failed to read tls_key_file: %w", err)
+	}
+	if files.clientCAFile != "" {
+		if m.clientCA, err = os.ReadFile(files.clientCAFile); err != nil {
+			return m, fmt.Errorf("failed to read tls_client_ca_file: %w", err)
+		}
+	}
+	return m, nil
+}
+
+func loadTLSConfig(files tlsFiles) (tlsMaterial, *tls.Config, error) {
+	material, err := readTLSMaterial(files)
+	if err != nil {
+		return material, nil, err
+	}
+	tlsConfig, err := buildTLSConfig(files, material)
+	return material, tlsConfig, err
+}
+
+func buildTLSConfig(files tlsFiles, material tlsMaterial) (*tls.Config, error) {
+	if len(files.clientSubjects) > 0 && files.clientCAFile == "" {
+		return nil, errors.New("tls_client_subjects requires tls_client_ca_file to be set")
+	}
+	cert, err := tls.X509KeyPair(material.cert, material.key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tls certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if material.clientCA == nil {
+		return tlsConfig, nil
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(material.clientCA) {
+		return nil, errors.New("tls_client_ca_file contains no certificates")
+	}
+	tlsConfig.ClientCAs = clientCAs
+	// the certificate is required by clientCertMiddleware, on the routes that need it
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
+
+// reload reads the tls files and replaces the tls config if their content changed. A failed reload
+// keeps the current config.
+func (t *tlsServing) reload() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	material, err := readTLSMaterial(t.files)
+	if err == nil && material.equals(t.material) {
+		return
+	}
+	var tlsConfig *tls.Config
+	if err == nil {
+		tlsConfig, err = buildTLSConfig(t.files, material)
+	}
+	if err != nil {
+		t.logger.Error("Failed to reload tls certificates, keeping current certificates", "error", err.Error())
+		return
+	}
+	t.material = material
+	t.current.Store(tlsConfig)
+	t.logger.Info("Reloaded tls certificates")
+}
+
+// watch starts watching the current files, falling back to polling every config_refresh_interval
+func (t *tlsServing) watch() {
+	t.done = make(chan struct{})
+	watcher, err := watchFiles(t.files.paths(), t.done, t.logger, t.reload)
+	if err == nil {
+		t.watcher = watcher
+		return
+	}
+	t.logger.Warn(fmt.Sprintf("Failed to watch tls files, falling back to polling every %s", t.interval), "error", err.Error())
+	t.ticker = pollEvery(t.interval, t.done, t.reload)
+}
+
+func (t *tlsServing) stopWatching() {
+	if t.done == nil {
+		return
+	}
+	close(t.done)
+	t.done = nil
+	if t.watcher != nil {
+		_ = t.watcher.Close()
+		t.watcher = nil
+	}
+	if t.ticker != nil {
+		t.ticker.Stop()
+		t.ticker = nil
+	}
+}
+
+func (t *tlsServing) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopWatching()
+}
+
+func (t *tlsServing) ValidateConfiguration(config *Config) error {
+	files := tlsFilesOf(config.LayerServiceConfig)
+	if files.certFile == "" && files.keyFile == "" {
+		// disabling tls requires a restart, which is warned about when the change is applied
+		return nil
+	}
+	_, _, err := loadTLSConfig(files)
+	return err
+}
+
+// UpdateConfiguration switches to the tls files of the config, and watches them from then on
+func (t *tlsServing) UpdateConfiguration(config *Config) TransformError {
+	files := tlsFilesOf(config.LayerServiceConfig)
+	if files.certFile == "" && files.keyFile == "" {
+		return nil
+	}
+	material, tlsConfig, err := loadTLSConfig(files)
+	if err != nil {
+		return Err(err, LayerErrorBadParameter)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pathsChanged := fmt.Sprint(files.paths()) != fmt.Sprint(t.files.paths())
+	t.files, t.material = files, material
+	t.current.Store(tlsConfig)
+	t.clients.Store(clientCertPolicyOf(files))
+	if pathsChanged {
+		t.stopWatching()
+		t.watch()
+	}
+	return nil
+}
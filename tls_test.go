@@ -0,0 +1,188 @@
+package common_http_transform
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate and key in PEM for the common name, usable for servers on localhost and for clients
+func (ca *testCA) issue(t *testing.T, commonName string, serial int64) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func writeTestFile(t *testing.T, file string, content []byte) {
+	t.Helper()
+	if err := os.WriteFile(file, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// replaceTestFile replaces file by renaming a new file over it, the way certificates are rotated
+func replaceTestFile(t *testing.T, file string, content []byte) {
+	t.Helper()
+	writeTestFile(t, file+".new", content)
+	if err := os.Rename(file+".new", file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSServingWithClientAllowlist(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	cert, key := ca.issue(t, "server", 2)
+	writeTestFile(t, certFile, cert)
+	writeTestFile(t, keyFile, key)
+	writeTestFile(t, caFile, ca.pem)
+
+	conf := fmt.Sprintf(`{"layer_config": {"log_level": "error", "port": "0", "tls_cert_file": %q, "tls_key_file": %q, "tls_client_ca_file": %q, "tls_client_subjects": ["datahub"]}}`, certFile, keyFile, caFile)
+	ws := newTestWebServiceWithConfig(t, conf, &testTransform{transform: func(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+		return ec, nil
+	}})
+	if err := ws.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ws.Stop(context.Background()) })
+	baseURL := fmt.Sprintf("https://127.0.0.1:%d", ws.e.Listener.Addr().(*net.TCPAddr).Port)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	// client returns a client without certificate for an empty common name. Every client opens its own connection.
+	client := func(commonName string) *http.Client {
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if commonName != "" {
+			clientCert, clientKey := ca.issue(t, commonName, 3)
+			pair, err := tls.X509KeyPair(clientCert, clientKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	}
+	post := func(commonName string) *http.Response {
+		t.Helper()
+		resp, err := client(commonName).Post(baseURL+"/transform", "application/json", strings.NewReader(testEntities))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	resp, err := client("").Get(baseURL + "/health")
+	if err != nil {
+		t.Fatalf("expected health probe without client certificate to connect, got %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected health probe without client certificate to be served, got %d", resp.StatusCode)
+	}
+
+	if resp = post("datahub"); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected allowed client to be served, got %d", resp.StatusCode)
+	}
+	if resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Errorf("expected server certificate with serial 2, got %d", resp.TLS.PeerCertificates[0].SerialNumber)
+	}
+	if resp = post(""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected transform without client certificate to be rejected with 401, got %d", resp.StatusCode)
+	}
+	if resp = post("someone else"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected client outside the allowlist to be rejected with 403, got %d", resp.StatusCode)
+	}
+
+	// rotate the server certificate, the watcher picks up the replaced files
+	cert, key = ca.issue(t, "server", 4)
+	replaceTestFile(t, keyFile, key)
+	replaceTestFile(t, certFile, cert)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp = post("datahub")
+		if resp.TLS.PeerCertificates[0].SerialNumber.Int64() == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected rotated server certificate with serial 4, got %d", resp.TLS.PeerCertificates[0].SerialNumber)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestTLSServingRejectsInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestFile(t, certFile, []byte("not a certificate"))
+	writeTestFile(t, keyFile, []byte("not a key"))
+
+	config, _ := readConfig(strings.NewReader(fmt.Sprintf(`{"layer_config": {"tls_cert_file": %q, "tls_key_file": %q}}`, certFile, keyFile)))
+	if _, err := newTLSServing(config, NewLogger("test", "json", "error")); err == nil {
+		t.Error("expected invalid certificate to be rejected")
+	}
+}
@@ -0,0 +1,142 @@
+package common_http_transform
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	tracerName = "github.com/mimiro-io/common-http-transform"
+
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+	TracingExporterFile   = "file"
+	TracingExporterNone   = "none"
+)
+
+// SpanFromContext returns the active span in ctx. Transform code can use it to add attributes and events
+// to the span the library opened around the Transform call. When tracing is disabled a no-op span is returned.
+func SpanFromContext(ctx context.Context) trace.Span {
+	return trace.SpanFromContext(ctx)
+}
+
+// TracerFromContext returns a tracer from the provider of the active span in ctx, for starting child spans
+// around calls to external systems. When tracing is disabled a no-op tracer is returned.
+func TracerFromContext(ctx context.Context) trace.Tracer {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+}
+
+// tracing holds the tracer provider configured by tracing_exporter. When tracing is disabled the
+// tracer is a no-op and the provider is nil.
+type tracing struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	file       *os.File
+}
+
+func newTracing(conf *LayerServiceConfig) (*tracing, error) {
+	t := &tracing{
+		tracer:     noop.NewTracerProvider().Tracer(tracerName),
+		propagator: propagation.TraceContext{},
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(conf.TracingExporter) {
+	case "", TracingExporterNone:
+		return t, nil
+	case TracingExporterOTLP:
+		var opts []otlptracehttp.Option
+		if conf.TracingEndpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(conf.TracingEndpoint))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case TracingExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TracingExporterFile:
+		if conf.TracingFile == "" {
+			return nil, fmt.Errorf("tracing_file is required when tracing_exporter is %s", TracingExporterFile)
+		}
+		t.file, err = os.OpenFile(conf.TracingFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(t.file))
+	default:
+		return nil, fmt.Errorf("unknown tracing_exporter %s, expected one of otlp, stdout, file, none", conf.TracingExporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(conf.ServiceName))),
+	)
+	t.tracer = t.provider.Tracer(tracerName)
+
+	// register globally, so that instrumented http clients used by transforms join the same trace
+	otel.SetTracerProvider(t.provider)
+	otel.SetTextMapPropagator(t.propagator)
+	return t, nil
+}
+
+// Stop flushes pending spans and shuts down the exporter
+func (t *tracing) Stop(ctx context.Context) error {
+	if t.provider == nil {
+		return nil
+	}
+	err := t.provider.Shutdown(ctx)
+	if t.file != nil {
+		_ = t.file.Close()
+	}
+	return err
+}
+
+// middleware starts a server span per request, continuing the trace given by the W3C traceparent header
+func (t *tracing) middleware(skipper func(c echo.Context) bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if skipper(c) || t.provider == nil {
+				return next(c)
+			}
+
+			req := c.Request()
+			ctx := t.propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+			ctx, span := t.tracer.Start(ctx, req.Method+" "+c.Path(),
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					semconv.HTTPRequestMethodKey.String(req.Method),
+					semconv.HTTPRoute(c.Path()),
+				))
+			defer span.End()
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+			if err != nil {
+				span.RecordError(err)
+			}
+			status := c.Response().Status
+			span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+			if status >= 500 {
+				span.SetStatus(codes.Error, fmt.Sprintf("status %d", status))
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package common_http_transform
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+type tracedTransform struct {
+	testTransform
+}
+
+func (tt *tracedTransform) Transform(ctx context.Context, ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	SpanFromContext(ctx).AddEvent("transform called")
+	_, span := TracerFromContext(ctx).Start(ctx, "lookup weather")
+	span.End()
+	return ec, nil
+}
+
+func TestTracingFileExporter(t *testing.T) {
+	traceFile := filepath.Join(t.TempDir(), "traces.json")
+	conf := fmt.Sprintf(`{"layer_config": {"service_name": "test", "tracing_exporter": "file", "tracing_file": %q}}`, traceFile)
+	ws := newTestWebServiceWithConfig(t, conf, ContextTransform(&tracedTransform{}))
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	rec := postTransform(ws, testEntities, map[string]string{"traceparent": "00-" + traceID + "-00f067aa0ba902b7-01"})
+	if rec.Code != 200 {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if err := ws.tracing.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	traces, err := os.ReadFile(traceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`"Name":"POST /transform"`, `"Name":"Transform"`, `"Name":"lookup weather"`, `"transform called"`} {
+		if !strings.Contains(string(traces), expected) {
+			t.Errorf("expected %s in exported spans", expected)
+		}
+	}
+	if strings.Count(string(traces), `"TraceID":"`+traceID+`"`) < 3 {
+		t.Errorf("expected all spans to continue trace %s, got %s", traceID, traces)
+	}
+}
@@ -19,3 +19,93 @@ type TransformService interface {
 	Transform(entityCollection *egdm.EntityCollection) (*egdm.EntityCollection, TransformError)
 	UpdateConfiguration(config *Config) TransformError
 }
+
+// StreamingTransformService can optionally be implemented by a TransformService. When it is, the web layer
+// prefers it over Transform: the request body is parsed incrementally, StreamEntity is called once per
+// parsed entity, and every entity passed to emit is written to the response straight away. This keeps memory
+// use flat regardless of batch size. An entity may be dropped by not calling emit, or expanded by calling it
+// several times.
+type StreamingTransformService interface {
+	TransformService
+	StreamEntity(ctx context.Context, entity *egdm.Entity, emit func(entity *egdm.Entity) error) TransformError
+}
+
+// ContextTransformService is a variant of TransformService whose Transform receives the request context.
+// The context is cancelled when the client disconnects or when the configured transform_timeout is exceeded,
+// so long-running calls to external systems can be abandoned. Use ContextTransform to return it from a
+// service factory.
+type ContextTransformService interface {
+	Stoppable
+	Transform(ctx context.Context, entityCollection *egdm.EntityCollection) (*egdm.EntityCollection, TransformError)
+	UpdateConfiguration(config *Config) TransformError
+}
+
+// contextTransformer is implemented by TransformServices that can make use of the request context
+type contextTransformer interface {
+	transformWithContext(ctx context.Context, entityCollection *egdm.EntityCollection) (*egdm.EntityCollection, TransformError)
+}
+
+// ContextTransform adapts a ContextTransformService to a TransformService, so that it can be returned from
+// the factory given to NewServiceRunner. The web layer detects the adapter and passes the request context on.
+func ContextTransform(service ContextTransformService) TransformService {
+	return &contextTransformAdapter{service: service}
+}
+
+type contextTransformAdapter struct {
+	service ContextTransformService
+}
+
+func (a *contextTransformAdapter) Stop(ctx context.Context) error {
+	return a.service.Stop(ctx)
+}
+
+func (a *contextTransformAdapter) Transform(entityCollection *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	return a.service.Transform(context.Background(), entityCollection)
+}
+
+func (a *contextTransformAdapter) UpdateConfiguration(config *Config) TransformError {
+	return a.service.UpdateConfiguration(config)
+}
+
+func (a *contextTransformAdapter) ValidateConfiguration(config *Config) error {
+	if validator, ok := a.service.(ConfigValidator); ok {
+		return validator.ValidateConfiguration(config)
+	}
+	return nil
+}
+
+func (a *contextTransformAdapter) CheckHealth(ctx context.Context) map[string]error {
+	if checker, ok := a.service.(HealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
+}
+
+func (a *contextTransformAdapter) transformWithContext(ctx context.Context, entityCollection *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	return a.service.Transform(ctx, entityCollection)
+}
+
+// TransformEntities runs the service on the entity collection the way the web layer does: a
+// StreamingTransformService is given one entity at a time and the emitted entities are collected, a
+// service adapted with ContextTransform is given ctx, and any other service is called with Transform.
+// The transform command of RunCLI and transformtest.RunGolden use it, so that a service behaves the
+// same there as on /transform.
+func TransformEntities(ctx context.Context, service TransformService, entityCollection *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	if streamingService, ok := service.(StreamingTransformService); ok {
+		output := egdm.NewEntityCollection(entityCollection.NamespaceManager)
+		output.SetContinuationToken(entityCollection.Continuation)
+		for _, entity := range entityCollection.Entities {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, Err(ctxErr, LayerErrorInternal)
+			}
+			if err := streamingService.StreamEntity(ctx, entity, output.AddEntity); err != nil {
+				return nil, err
+			}
+		}
+		return output, nil
+	}
+	if contextService, ok := service.(contextTransformer); ok {
+		return contextService.transformWithContext(ctx, entityCollection)
+	}
+	return service.Transform(entityCollection)
+}
@@ -0,0 +1,208 @@
+package transformtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	ct "github.com/mimiro-io/common-http-transform"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+// update is namespaced, so that it cannot clash with an -update flag of the importing test package
+var update = flag.Bool("transformtest.update", false, "write the output of RunGolden to the golden files instead of comparing")
+
+// updateGolden reports whether the golden files are written instead of compared: with -transformtest.update,
+// or with -update if the test binary defines that flag itself. It is read when RunGolden runs, after the
+// flags are parsed.
+func updateGolden() bool {
+	if *update {
+		return true
+	}
+	if f := flag.Lookup("update"); f != nil {
+		if getter, ok := f.Value.(flag.Getter); ok {
+			value, _ := getter.Get().(bool)
+			return value
+		}
+	}
+	return false
+}
+
+const (
+	goldenInputSuffix  = ".input.json"
+	goldenOutputSuffix = ".golden.json"
+	goldenConfigFile   = "config.json"
+)
+
+// RunGolden runs every <name>.input.json in dir through the TransformService built by the factory, and
+// compares the result with <name>.golden.json in a subtest per file. Entities are compared with expanded
+// URIs, so property order and namespace prefixes do not matter; the order of the entities does. A
+// config.json in dir is given to the factory. Run the test with -transformtest.update, or -update if the
+// test package defines it, to write the golden files from the current output.
+func RunGolden(
+	t *testing.T,
+	newTransformService func(config *ct.Config, logger ct.Logger, metrics ct.Metrics) (ct.TransformService, error),
+	dir string,
+) {
+	t.Helper()
+
+	inputs, err := filepath.Glob(filepath.Join(dir, "*"+goldenInputSuffix))
+	if err != nil {
+		t.Fatalf("failed to list input files: %v", err)
+	}
+	if len(inputs) == 0 {
+		t.Fatalf("no *%s files in %s", goldenInputSuffix, dir)
+	}
+	sort.Strings(inputs)
+
+	service, err := newTransformService(readGoldenConfig(t, dir), NewLogger(), NewMetrics())
+	if err != nil {
+		t.Fatalf("failed to create transform service: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = service.Stop(context.Background())
+	})
+
+	for _, input := range inputs {
+		input := input
+		name := strings.TrimSuffix(filepath.Base(input), goldenInputSuffix)
+		t.Run(name, func(t *testing.T) {
+			golden := strings.TrimSuffix(input, goldenInputSuffix) + goldenOutputSuffix
+			output := runGoldenInput(t, service, input)
+			if updateGolden() {
+				writeGolden(t, golden, output)
+				return
+			}
+			compareGolden(t, golden, output)
+		})
+	}
+}
+
+func readGoldenConfig(t *testing.T, dir string) *ct.Config {
+	t.Helper()
+	config := &ct.Config{}
+	content, err := os.ReadFile(filepath.Join(dir, goldenConfigFile))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("failed to read %s: %v", goldenConfigFile, err)
+	}
+	if err == nil {
+		if err = json.Unmarshal(content, config); err != nil {
+			t.Fatalf("failed to parse %s: %v", goldenConfigFile, err)
+		}
+	}
+	if config.LayerServiceConfig == nil {
+		config.LayerServiceConfig = &ct.LayerServiceConfig{}
+	}
+	return config
+}
+
+// parseEntities parses an entity graph json document the way the /transform endpoint does
+func parseEntities(r io.Reader) (*egdm.EntityCollection, error) {
+	nsManager := egdm.NewNamespaceContext()
+	parser := egdm.NewEntityParser(nsManager)
+	parser.WithExpandURIs()
+	ec := egdm.NewEntityCollection(nsManager)
+	err := parser.Parse(r, ec.AddEntity, ec.SetContinuationToken)
+	return ec, err
+}
+
+// runGoldenInput transforms the entities in the input file with ct.TransformEntities, which dispatches
+// like the /transform endpoint does
+func runGoldenInput(t *testing.T, service ct.TransformService, input string) *egdm.EntityCollection {
+	t.Helper()
+	file, err := os.Open(input)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", input, err)
+	}
+	defer file.Close()
+	ec, err := parseEntities(file)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", input, err)
+	}
+
+	output, transformErr := ct.TransformEntities(context.Background(), service, ec)
+	if transformErr != nil {
+		t.Fatalf("failed to transform %s: %v", input, transformErr)
+	}
+	if output == nil {
+		t.Fatalf("transform of %s returned no entity collection", input)
+	}
+	return output
+}
+
+func writeGolden(t *testing.T, golden string, output *egdm.EntityCollection) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := output.WriteEntityGraphJSON(&buf); err != nil {
+		t.Fatalf("failed to write %s: %v", golden, err)
+	}
+	buf.WriteString("\n")
+	if err := os.WriteFile(golden, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("failed to write %s: %v", golden, err)
+	}
+}
+
+func compareGolden(t *testing.T, golden string, output *egdm.EntityCollection) {
+	t.Helper()
+	file, err := os.Open(golden)
+	if os.IsNotExist(err) {
+		t.Fatalf("%s does not exist, run the test with -transformtest.update to create it", golden)
+	}
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", golden, err)
+	}
+	defer file.Close()
+	expected, err := parseEntities(file)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", golden, err)
+	}
+
+	// round trip the output, so that it is compared in the form a caller of /transform would see
+	var buf bytes.Buffer
+	if err = output.WriteEntityGraphJSON(&buf); err != nil {
+		t.Fatalf("failed to write the output: %v", err)
+	}
+	actual, err := parseEntities(&buf)
+	if err != nil {
+		t.Fatalf("failed to parse the output: %v", err)
+	}
+
+	if len(actual.Entities) != len(expected.Entities) {
+		t.Errorf("expected %d entities, got %d", len(expected.Entities), len(actual.Entities))
+	}
+	for i := 0; i < len(actual.Entities) && i < len(expected.Entities); i++ {
+		want, got := canonicalEntity(t, expected.Entities[i]), canonicalEntity(t, actual.Entities[i])
+		if want != got {
+			t.Errorf("entity %d differs from %s\nexpected:\n%s\ngot:\n%s", i, filepath.Base(golden), want, got)
+		}
+	}
+	if expected.Continuation != nil || actual.Continuation != nil {
+		want, got := "", ""
+		if expected.Continuation != nil {
+			want = expected.Continuation.Token
+		}
+		if actual.Continuation != nil {
+			got = actual.Continuation.Token
+		}
+		if want != got {
+			t.Errorf("expected continuation token %q, got %q", want, got)
+		}
+	}
+}
+
+// canonicalEntity renders an entity with sorted keys, so that entities can be compared as strings
+func canonicalEntity(t *testing.T, entity *egdm.Entity) string {
+	t.Helper()
+	content, err := json.MarshalIndent(entity, "", "  ")
+	if err != nil {
+		t.Fatalf("failed to render entity %s: %v", entity.ID, err)
+	}
+	return string(content)
+}
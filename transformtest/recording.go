@@ -0,0 +1,133 @@
+package transformtest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	ct "github.com/mimiro-io/common-http-transform"
+)
+
+// LogEntry is a message recorded by Logger
+type LogEntry struct {
+	Level   string
+	Message string
+	Fields  map[string]string
+}
+
+// Logger is a ct.Logger that records every message, including those of loggers derived with With
+type Logger struct {
+	mu      *sync.Mutex
+	entries *[]LogEntry
+	fields  map[string]string
+}
+
+func NewLogger() *Logger {
+	return &Logger{mu: &sync.Mutex{}, entries: &[]LogEntry{}, fields: map[string]string{}}
+}
+
+func (l *Logger) record(level string, message string, args []any) {
+	fields := map[string]string{}
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	for i := 0; i+1 < len(args); i += 2 {
+		fields[fmt.Sprint(args[i])] = fmt.Sprint(args[i+1])
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	*l.entries = append(*l.entries, LogEntry{Level: level, Message: message, Fields: fields})
+}
+
+func (l *Logger) Error(message string, args ...any) { l.record("error", message, args) }
+func (l *Logger) Info(message string, args ...any)  { l.record("info", message, args) }
+func (l *Logger) Debug(message string, args ...any) { l.record("debug", message, args) }
+func (l *Logger) Warn(message string, args ...any)  { l.record("warn", message, args) }
+
+func (l *Logger) With(name string, value string) ct.Logger {
+	fields := map[string]string{}
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[name] = value
+	return &Logger{mu: l.mu, entries: l.entries, fields: fields}
+}
+
+// Entries returns the recorded messages of the given level, or of all levels if level is empty
+func (l *Logger) Entries(level string) []LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var result []LogEntry
+	for _, entry := range *l.entries {
+		if level == "" || entry.Level == level {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// Contains reports whether a message of the given level contains text
+func (l *Logger) Contains(level string, text string) bool {
+	for _, entry := range l.Entries(level) {
+		if strings.Contains(entry.Message, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// Metrics is a ct.Metrics that records every reported value
+type Metrics struct {
+	mu       sync.Mutex
+	counters map[string]int
+	timings  map[string][]time.Duration
+	gauges   map[string]float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{counters: map[string]int{}, timings: map[string][]time.Duration{}, gauges: map[string]float64{}}
+}
+
+func (m *Metrics) Incr(name string, _ []string, _ int) ct.TransformError {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name]++
+	return nil
+}
+
+func (m *Metrics) Timing(name string, value time.Duration, _ []string, _ int) ct.TransformError {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.timings[name] = append(m.timings[name], value)
+	return nil
+}
+
+func (m *Metrics) Gauge(name string, value float64, _ []string, _ int) ct.TransformError {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = value
+	return nil
+}
+
+// Count returns how often the counter was incremented
+func (m *Metrics) Count(name string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[name]
+}
+
+// Timings returns the recorded timings
+func (m *Metrics) Timings(name string) []time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]time.Duration(nil), m.timings[name]...)
+}
+
+// GaugeValue returns the last value of the gauge, and whether it was reported at all
+func (m *Metrics) GaugeValue(name string) (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.gauges[name]
+	return value, ok
+}
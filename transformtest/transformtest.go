@@ -0,0 +1,160 @@
+// Package transformtest runs a transform service in process, so that it can be tested over http
+// without a config file or a fixed port.
+//
+//	func TestMyTransform(t *testing.T) {
+//		svc := transformtest.Start(t, NewMyTransform, &ct.Config{
+//			ExternalSystemConfig: ct.ExternalSystemConfig{"endpoint": "http://localhost"},
+//		})
+//		result := svc.Post(entity)
+//		...
+//	}
+package transformtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ct "github.com/mimiro-io/common-http-transform"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+// Service is a transform service started by Start. It is stopped when the test ends.
+type Service struct {
+	t      testing.TB
+	runner *ct.ServiceRunner
+	client *http.Client
+
+	// URL is the base url of the service, e.g. http://127.0.0.1:41234
+	URL string
+	// Logger records everything the service logs
+	Logger *Logger
+	// Metrics records everything the service reports
+	Metrics *Metrics
+}
+
+// Start starts a ServiceRunner for the factory on a random port. The config is written to a temporary
+// config file; a nil config starts the service with defaults. The service is stopped with t.Cleanup.
+func Start(
+	t testing.TB,
+	newTransformService func(config *ct.Config, logger ct.Logger, metrics ct.Metrics) (ct.TransformService, error),
+	config *ct.Config,
+) *Service {
+	t.Helper()
+
+	configFile := writeConfig(t, config)
+	svc := &Service{
+		t:       t,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		Logger:  NewLogger(),
+		Metrics: NewMetrics(),
+	}
+	svc.runner = ct.NewServiceRunner(newTransformService).
+		WithConfigLocation(configFile).
+		WithLogger(svc.Logger).
+		WithMetrics(svc.Metrics)
+	if err := svc.runner.Start(); err != nil {
+		t.Fatalf("failed to start transform service: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := svc.runner.Stop(); err != nil {
+			t.Errorf("failed to stop transform service: %v", err)
+		}
+	})
+	svc.URL = "http://" + svc.runner.Addr().String()
+	return svc
+}
+
+// writeConfig writes the config as json with port 0, so that the service listens on a random port, and
+// without a drain delay, so that stopping the service does not slow the tests down
+func writeConfig(t testing.TB, config *ct.Config) string {
+	t.Helper()
+	conf := ct.Config{}
+	if config != nil {
+		conf = *config
+	}
+	layerConfig := ct.LayerServiceConfig{}
+	if conf.LayerServiceConfig != nil {
+		layerConfig = *conf.LayerServiceConfig
+	}
+	if layerConfig.ServiceName == "" {
+		layerConfig.ServiceName = "transformtest"
+	}
+	layerConfig.Port = "0"
+	conf.LayerServiceConfig = &layerConfig
+
+	content, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err = os.WriteFile(configFile, content, 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return configFile
+}
+
+// Runner returns the ServiceRunner, e.g. to get the TransformService created by the factory
+func (s *Service) Runner() *ct.ServiceRunner {
+	return s.runner
+}
+
+// Post sends the entities to /transform and returns the transformed entities. The test fails if the
+// service does not answer with 200.
+func (s *Service) Post(entities ...*egdm.Entity) *egdm.EntityCollection {
+	s.t.Helper()
+	ec := egdm.NewEntityCollection(egdm.NewNamespaceContext())
+	for _, entity := range entities {
+		if err := ec.AddEntity(entity); err != nil {
+			s.t.Fatalf("failed to add entity %s: %v", entity.ID, err)
+		}
+	}
+	return s.PostCollection(ec)
+}
+
+// PostCollection sends the entity collection to /transform and returns the transformed entities. The
+// test fails if the service does not answer with 200.
+func (s *Service) PostCollection(ec *egdm.EntityCollection) *egdm.EntityCollection {
+	s.t.Helper()
+	var body bytes.Buffer
+	if err := ec.WriteEntityGraphJSON(&body); err != nil {
+		s.t.Fatalf("failed to write entities: %v", err)
+	}
+
+	resp := s.PostRaw(&body, nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		problem, _ := io.ReadAll(resp.Body)
+		s.t.Fatalf("expected status 200 from /transform, got %d: %s", resp.StatusCode, problem)
+	}
+
+	result, err := egdm.NewEntityParser(egdm.NewNamespaceContext()).WithExpandURIs().LoadEntityCollection(resp.Body)
+	if err != nil {
+		s.t.Fatalf("failed to parse response: %v", err)
+	}
+	return result
+}
+
+// PostRaw sends body to /transform as is, for tests of error responses or headers. The caller closes
+// the response body.
+func (s *Service) PostRaw(body io.Reader, headers map[string]string) *http.Response {
+	s.t.Helper()
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/transform", body)
+	if err != nil {
+		s.t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.t.Fatalf("failed to call /transform: %v", err)
+	}
+	return resp
+}
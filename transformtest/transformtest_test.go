@@ -0,0 +1,94 @@
+package transformtest
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"strings"
+	"testing"
+
+	ct "github.com/mimiro-io/common-http-transform"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+// a test package may define its own -update flag next to RunGolden
+var updateFlag = flag.Bool("update", false, "update golden files")
+
+type suffixTransform struct {
+	suffix string
+}
+
+func newSuffixTransform(config *ct.Config, logger ct.Logger, _ ct.Metrics) (ct.TransformService, error) {
+	suffix, _ := config.ExternalSystemConfig["suffix"].(string)
+	logger.Info("suffix transform created", "suffix", suffix)
+	return &suffixTransform{suffix: suffix}, nil
+}
+
+func (s *suffixTransform) Stop(_ context.Context) error                       { return nil }
+func (s *suffixTransform) UpdateConfiguration(_ *ct.Config) ct.TransformError { return nil }
+
+func (s *suffixTransform) Transform(ec *egdm.EntityCollection) (*egdm.EntityCollection, ct.TransformError) {
+	for _, entity := range ec.GetEntities() {
+		entity.ID = entity.ID + s.suffix
+	}
+	return ec, nil
+}
+
+func TestStartAndPost(t *testing.T) {
+	svc := Start(t, newSuffixTransform, &ct.Config{
+		ExternalSystemConfig: ct.ExternalSystemConfig{"suffix": "-transformed"},
+	})
+
+	result := svc.Post(egdm.NewEntity().SetID("http://data.example.io/a"), egdm.NewEntity().SetID("http://data.example.io/b"))
+	entities := result.GetEntities()
+	if len(entities) != 2 || entities[0].ID != "http://data.example.io/a-transformed" || entities[1].ID != "http://data.example.io/b-transformed" {
+		t.Fatalf("unexpected entities %v", entities)
+	}
+
+	if !svc.Logger.Contains("info", "suffix transform created") {
+		t.Errorf("expected the factory log message to be recorded, got %v", svc.Logger.Entries(""))
+	}
+	if svc.Metrics.Count("http.count") != 1 || len(svc.Metrics.Timings("http.time")) != 1 {
+		t.Errorf("expected the request metrics to be recorded once")
+	}
+}
+
+func TestLoggerWithOverridesInheritedFields(t *testing.T) {
+	logger := NewLogger()
+	logger.With("stage", "normalise").With("stage", "enrich").Info("stage started")
+
+	entries := logger.Entries("info")
+	if len(entries) != 1 || entries[0].Fields["stage"] != "enrich" {
+		t.Errorf("expected the field of the derived logger to win, got %v", entries)
+	}
+}
+
+func TestPostRaw(t *testing.T) {
+	svc := Start(t, newSuffixTransform, nil)
+
+	resp := svc.PostRaw(strings.NewReader("not json"), nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestRunGolden(t *testing.T) {
+	RunGolden(t, newSuffixTransform, "testdata/golden")
+}
+
+func TestUpdateGoldenHonoursUpdateFlagOfTestPackage(t *testing.T) {
+	if updateGolden() != *updateFlag {
+		t.Fatalf("expected the -update flag of the test package to be used")
+	}
+	if *updateFlag {
+		return
+	}
+	if err := flag.Set("update", "true"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = flag.Set("update", "false") }()
+	if !updateGolden() {
+		t.Error("expected -update of the test package to write the golden files")
+	}
+}
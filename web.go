@@ -2,15 +2,24 @@ package common_http_transform
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	egdm "github.com/mimiro-io/entity-graph-data-model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type transformWebService struct {
@@ -20,34 +29,177 @@ type transformWebService struct {
 	metrics          Metrics
 	logger           Logger
 	config           *Config
+	settings         atomic.Pointer[webSettings]
+	limiter          *transformLimiter
+	tracing          *tracing
+	health           *health
+	auth             *jwtAuth
+	tls              *tlsServing
+	// transformMiddleware is applied to every transform route
+	transformMiddleware []echo.MiddlewareFunc
+	// inFlight counts the transform requests being handled, handlers is waited on when stopping
+	inFlight atomic.Int64
+	handlers sync.WaitGroup
 }
 
+// transformEndpoint is a TransformService served on a transform route, with the logger used for its requests
+type transformEndpoint struct {
+	service TransformService
+	logger  Logger
+}
+
+// webSettings are the parts of layer_config applied per request. They are replaced as a whole
+// when the config changes.
+type webSettings struct {
+	transformTimeout time.Duration
+	drainDelay       time.Duration
+	partialFailures  *partialFailurePolicy
+	maxRequestBytes  int64
+	maxEntities      int
+	limits           transformLimits
+
+	compressionEnabled  bool
+	compressionMinBytes int
+}
+
+func newWebSettings(config *Config, logger Logger, metrics Metrics) (*webSettings, error) {
+	settings := &webSettings{}
+	if config.LayerServiceConfig.TransformTimeout != "" {
+		timeout, err := asDuration(config.LayerServiceConfig.TransformTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transform_timeout: %w", err)
+		}
+		settings.transformTimeout = timeout
+	}
+	if config.LayerServiceConfig.ShutdownDrainDelay != "" {
+		delay, err := asDuration(config.LayerServiceConfig.ShutdownDrainDelay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shutdown_drain_delay: %w", err)
+		}
+		settings.drainDelay = delay
+	}
+	partialFailures, err := newPartialFailurePolicy(config.LayerServiceConfig, logger, metrics)
+	if err != nil {
+		return nil, err
+	}
+	settings.partialFailures = partialFailures
+	conf := config.LayerServiceConfig
+	if conf.MaxRequestBytes < 0 || conf.MaxEntitiesPerRequest < 0 {
+		return nil, errors.New("max_request_bytes and max_entities_per_request must not be negative")
+	}
+	settings.maxRequestBytes = conf.MaxRequestBytes
+	settings.maxEntities = conf.MaxEntitiesPerRequest
+	settings.limits, err = transformLimitsOf(conf)
+	if err != nil {
+		return nil, err
+	}
+	settings.compressionEnabled = conf.CompressionEnabled
+	settings.compressionMinBytes = defaultCompressionMinBytes
+	if conf.CompressionMinBytes != nil {
+		if *conf.CompressionMinBytes < 0 {
+			return nil, errors.New("compression_min_bytes must not be negative")
+		}
+		settings.compressionMinBytes = *conf.CompressionMinBytes
+	}
+	return settings, nil
+}
+
+// stragglerWait bounds the wait for handlers to return once their connections have been closed
+const stragglerWait = 5 * time.Second
+
+// statusClientClosedRequest is reported when the client goes away before the transform completes
+const statusClientClosedRequest = 499
+
 func newTransformService(config *Config, logger Logger, metrics Metrics, transformService TransformService) (*transformWebService, error) {
+	t, err := newTracing(config.LayerServiceConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	e := echo.New()
 	e.HideBanner = true
+	e.Use(t.middleware(skipper))
 	mw(logger, metrics, e)
-	s := &transformWebService{config: config, logger: logger, metrics: metrics, transformService: transformService, e: e}
-	e.GET("/health", s.health)
-	e.POST("/transform", s.transform)
+	s := &transformWebService{config: config, logger: logger, metrics: metrics, transformService: transformService, e: e, tracing: t}
+	settings, err := newWebSettings(config, logger, metrics)
+	if err != nil {
+		return nil, err
+	}
+	s.settings.Store(settings)
+	s.limiter = newTransformLimiter(settings.limits)
+	s.health, err = newHealth(config, transformService)
+	if err != nil {
+		return nil, err
+	}
+	e.GET("/health", s.running)
+	e.GET("/health/live", s.health.live)
+	e.GET("/health/ready", s.health.ready)
+	if pm := prometheusMetricsOf(metrics); pm != nil {
+		e.GET("/metrics", echo.WrapHandler(pm.Handler()))
+	}
+	s.tls, err = newTLSServing(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	s.auth, err = newJWTAuth(config.LayerServiceConfig, logger)
+	if err != nil {
+		return nil, err
+	}
+	if s.tls != nil {
+		s.transformMiddleware = append(s.transformMiddleware, s.tls.clientCertMiddleware)
+	}
+	if s.auth != nil {
+		s.transformMiddleware = append(s.transformMiddleware, s.auth.middleware)
+	}
+	s.transformMiddleware = append(s.transformMiddleware, compression(func() (bool, int) {
+		settings := s.settings.Load()
+		return settings.compressionEnabled, settings.compressionMinBytes
+	}))
+	s.addRoute("/transform", &transformEndpoint{service: transformService, logger: logger})
 	return s, nil
 }
 
+// addTransform serves a named TransformService on POST /transform/<name>. Its health checks are added
+// to the readiness probe, prefixed with the name.
+func (ws *transformWebService) addTransform(name string, transformService TransformService, logger Logger) {
+	ws.addRoute("/transform/"+name, &transformEndpoint{service: transformService, logger: logger})
+	ws.health.addChecker(name, transformService)
+}
+
+func (ws *transformWebService) addRoute(path string, endpoint *transformEndpoint) {
+	ws.e.POST(path, func(c echo.Context) error {
+		return ws.transform(c, endpoint)
+	}, ws.transformMiddleware...)
+}
+
+// skipper excludes operational endpoints from request logging, metrics and tracing
+func skipper(c echo.Context) bool {
+	// skip health check and metrics scraping
+	path := c.Request().URL.Path
+	return strings.HasPrefix(path, "/health") || strings.HasPrefix(path, "/metrics")
+}
+
 // wrap all handlers with middleware
 func mw(logger Logger, metrics Metrics, e *echo.Echo) {
-	skipper := func(c echo.Context) bool {
-		// skip health check
-		return strings.HasPrefix(c.Request().URL.Path, "/health")
-	}
-	defaultErrorHandler := e.HTTPErrorHandler
 	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		msg := err.Error()
+		var he *echo.HTTPError
+		if errors.As(err, &he) && he.Internal != nil {
+			msg = he.Internal.Error()
+		}
 		if c.Response().Committed {
-			logger.Error("Internal Error. Response already committed to 200 but will produce truncated/invalid payload.", "error", err.Error())
+			logger.Error("Internal Error. Response already committed to 200 but will produce truncated/invalid payload.", "error", msg)
+			return
+		}
+		if status := toProblem(err).Status; status < http.StatusInternalServerError {
+			logger.Warn("Request failed", "status", status, "error", msg)
 		} else {
-			logger.Error("Internal Error", "error", err.Error())
+			logger.Error("Internal Error", "status", status, "error", msg)
 		}
-		defaultErrorHandler(err, c)
+		writeProblem(c, err)
 	}
 	e.Use(
+		middleware.RequestID(),
 		// Request logging and HTTP metrics
 		func(next echo.HandlerFunc) echo.HandlerFunc {
 			// service := core.Config.SystemConfig.ServiceName()
@@ -57,12 +209,6 @@ func mw(logger Logger, metrics Metrics, e *echo.Echo) {
 				}
 
 				start := time.Now()
-				tags := []string{
-					// fmt.Sprintf("application:%s", service),
-					fmt.Sprintf("method:%s", strings.ToLower(c.Request().Method)),
-					fmt.Sprintf("url:%s", strings.ToLower(c.Request().RequestURI)),
-					fmt.Sprintf("status:%d", c.Response().Status),
-				}
 
 				// Recover from panic
 				defer func() {
@@ -89,6 +235,14 @@ func mw(logger Logger, metrics Metrics, e *echo.Echo) {
 
 				timed := time.Since(start)
 
+				// the tags are built once the response is written, so that they carry the final status. The
+				// route rather than the request uri is used, to keep the number of distinct tag values bounded.
+				tags := []string{
+					// fmt.Sprintf("application:%s", service),
+					fmt.Sprintf("method:%s", strings.ToLower(c.Request().Method)),
+					fmt.Sprintf("url:%s", strings.ToLower(c.Path())),
+					fmt.Sprintf("status:%d", c.Response().Status),
+				}
 				err = metrics.Incr("http.count", tags, 1)
 				err = metrics.Timing("http.time", timed, tags, 1)
 				err = metrics.Gauge("http.size", float64(c.Response().Size), tags, 1)
@@ -113,6 +267,9 @@ func mw(logger Logger, metrics Metrics, e *echo.Echo) {
 					id = c.Response().Header().Get(echo.HeaderXRequestID)
 					args = append(args, "request_id", id)
 				}
+				if spanContext := trace.SpanContextFromContext(c.Request().Context()); spanContext.HasTraceID() {
+					args = append(args, "trace_id", spanContext.TraceID().String())
+				}
 
 				logger.Info(msg, args...)
 
@@ -121,38 +278,258 @@ func mw(logger Logger, metrics Metrics, e *echo.Echo) {
 		})
 }
 
+// writeProblem renders err as an RFC 7807 problem+json response
+func writeProblem(c echo.Context, err error) {
+	p := toProblem(err)
+	p.RequestID = c.Request().Header.Get(echo.HeaderXRequestID)
+	if p.RequestID == "" {
+		p.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+	}
+
+	if c.Request().Method == http.MethodHead {
+		_ = c.NoContent(p.Status)
+		return
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		_ = c.NoContent(p.Status)
+		return
+	}
+	_ = c.Blob(p.Status, mimeApplicationProblemJSON, body)
+}
+
+// Start binds the listener and serves in the background. Errors binding the port are returned
+// as ErrListen, errors while serving are logged.
 func (ws *transformWebService) Start() error {
 	port := ws.config.LayerServiceConfig.Port
-	ws.logger.Info(fmt.Sprintf("Starting Http server on :%s", port))
+	listener, err := net.Listen("tcp", ":"+port.String())
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrListen, err)
+	}
+	if ws.tls != nil {
+		ws.logger.Info(fmt.Sprintf("Starting Https server on :%s", port))
+		listener = tls.NewListener(listener, ws.tls.serverConfig())
+	} else {
+		ws.logger.Info(fmt.Sprintf("Starting Http server on :%s", port))
+	}
+	ws.e.Listener = listener
+
 	go func() {
-		_ = ws.e.Start(":" + port.String())
+		err := ws.e.Start("")
+		if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			ws.logger.Error("Http server failed", "error", err.Error())
+		}
 	}()
 
 	return nil
 }
 
+// Stop drains the http server: the readiness probe fails, and after shutdown_drain_delay no new
+// connections are accepted and in-flight requests are given until the context is done to complete.
+// The deadline of the context is moved back by the drain delay, so that the delay does not use up
+// the time given to in-flight requests.
+// Requests still running then are terminated by closing their connections, and their handlers are
+// waited for, so that the transform service is not stopped under a running transform. An error is
+// returned if handlers are still running after that.
 func (ws *transformWebService) Stop(ctx context.Context) error {
-	return ws.e.Shutdown(ctx)
+	ws.health.drain()
+	if delay := ws.settings.Load().drainDelay; delay > 0 && ws.e.Listener != nil {
+		// give load balancers time to see the failing readiness probe before connections are refused
+		deadline, hasDeadline := ctx.Deadline()
+		timeout := time.Until(deadline)
+		time.Sleep(delay)
+		if hasDeadline && ctx.Err() != context.Canceled {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(context.WithoutCancel(ctx), timeout)
+			defer cancel()
+		}
+	}
+	if inFlight := ws.inFlight.Load(); inFlight > 0 {
+		ws.logger.Info(fmt.Sprintf("Waiting for %d in-flight transforms to complete", inFlight))
+	}
+	err := ws.e.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		ws.logger.Warn(fmt.Sprintf("Shutdown timeout reached, terminating %d in-flight transforms", ws.inFlight.Load()))
+		err = ws.e.Close()
+		if !ws.waitForHandlers(stragglerWait) {
+			err = fmt.Errorf("%d transforms still running after shutdown", ws.inFlight.Load())
+			ws.logger.Error(err.Error())
+		}
+	}
+	if ws.e.Listener != nil {
+		// the server only closes the listener once it is serving, which may not have happened yet
+		_ = ws.e.Listener.Close()
+	}
+	if ws.auth != nil {
+		_ = ws.auth.Stop(ctx)
+	}
+	if ws.tls != nil {
+		ws.tls.stop()
+	}
+	tracingCtx := ctx
+	if ctx.Err() != nil {
+		// give the exporter a moment to flush the spans of terminated requests
+		var cancel context.CancelFunc
+		tracingCtx, cancel = context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+	}
+	if tracingErr := ws.tracing.Stop(tracingCtx); err == nil {
+		err = tracingErr
+	}
+	return err
+}
+
+// waitForHandlers waits for the transform handlers to return, reporting whether they did within timeout
+func (ws *transformWebService) waitForHandlers(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		ws.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// ValidateConfiguration checks the settings the web service applies per request
+func (ws *transformWebService) ValidateConfiguration(config *Config) error {
+	if _, err := newWebSettings(config, ws.logger, ws.metrics); err != nil {
+		return err
+	}
+	if ws.tls != nil {
+		return ws.tls.ValidateConfiguration(config)
+	}
+	return nil
+}
+
+// UpdateConfiguration applies changed per request settings. Settings bound at startup only produce a warning.
+func (ws *transformWebService) UpdateConfiguration(config *Config) TransformError {
+	settings, err := newWebSettings(config, ws.logger, ws.metrics)
+	if err != nil {
+		return Err(err, LayerErrorBadParameter)
+	}
+	if ws.tls != nil {
+		if err := ws.tls.UpdateConfiguration(config); err != nil {
+			return err
+		}
+	}
+	warnRestartRequired(ws.logger, ws.config.LayerServiceConfig, config.LayerServiceConfig)
+	ws.settings.Store(settings)
+	ws.limiter.resize(settings.limits)
+	ws.config = config
+	return nil
 }
 
-func (ws *transformWebService) health(c echo.Context) error {
+func (ws *transformWebService) running(c echo.Context) error {
 	return c.String(http.StatusOK, "running")
 }
 
-func (ws *transformWebService) transform(c echo.Context) error {
-	parser := egdm.NewEntityParser(egdm.NewNamespaceContext())
+// transformContext derives the context for a single transform call from the request context,
+// applying the configured transform timeout
+func (ws *transformWebService) transformContext(c echo.Context, settings *webSettings) (context.Context, context.CancelFunc) {
+	ctx := c.Request().Context()
+	if settings.transformTimeout > 0 {
+		return context.WithTimeout(ctx, settings.transformTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// contextError translates a cancelled transform context into an error response. The deadline
+// being exceeded is reported as a gateway timeout, a client disconnect as 499.
+func (ws *transformWebService) contextError(ctx context.Context, settings *webSettings, logger Logger) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		logger.Warn("transform timed out", "timeout", settings.transformTimeout.String())
+		return Errorf(LayerErrorUpstreamTimeout, "transform did not complete within %s", settings.transformTimeout).toHTTPError()
+	case context.Canceled:
+		logger.Warn("client disconnected before transform completed")
+		return echo.NewHTTPError(statusClientClosedRequest, "client closed request")
+	}
+	return nil
+}
+
+// transform handles a POST of entities to the route of the endpoint
+func (ws *transformWebService) transform(c echo.Context, endpoint *transformEndpoint) error {
+	ws.handlers.Add(1)
+	defer ws.handlers.Done()
+	ws.inFlight.Add(1)
+	defer ws.inFlight.Add(-1)
+
+	settings := ws.settings.Load()
+	if err := limitRequestBody(c, settings.maxRequestBytes); err != nil {
+		ws.reportRejected(c, "bytes")
+		return err.toHTTPError()
+	}
+	if err := ws.acquire(c.Request().Context(), c, ws.limiter); err != nil {
+		if ctxErr := ws.contextError(c.Request().Context(), settings, endpoint.logger); ctxErr != nil {
+			return ctxErr
+		}
+		return err.toHTTPError()
+	}
+	defer func() {
+		ws.limiter.release()
+		ws.reportConcurrency(ws.limiter)
+	}()
+
+	// transform_timeout starts once the transform is admitted, the time spent queued is bounded by max_queue_wait
+	ctx, cancel := ws.transformContext(c, settings)
+	defer cancel()
+
+	if streamingService, ok := endpoint.service.(StreamingTransformService); ok {
+		return ws.transformStream(ctx, c, endpoint, settings, streamingService)
+	}
+
+	nsManager := egdm.NewNamespaceContext()
+	parser := egdm.NewEntityParser(nsManager)
 	parser.WithExpandURIs()
-	ec, err := parser.LoadEntityCollection(c.Request().Body)
+	ec := egdm.NewEntityCollection(nsManager)
+	count := countEntities(settings.maxEntities)
+	err := parser.Parse(c.Request().Body, func(entity *egdm.Entity) error {
+		if err := count(); err != nil {
+			return err
+		}
+		return ec.AddEntity(entity)
+	}, ec.SetContinuationToken)
 
 	if err != nil {
-		ws.logger.Warn(err.Error())
-		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("could not parse the request body: %s", err.Error()))
+		if ctxErr := ws.contextError(ctx, settings, endpoint.logger); ctxErr != nil {
+			return ctxErr
+		}
+		endpoint.logger.Warn(err.Error())
+		return ws.parseError(c, err)
 	}
 
-	transformed, err := ws.transformService.Transform(ec)
-	if err != nil {
-		ws.logger.Warn(err.Error())
-		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("could not process the entities: %", err.Error()))
+	ctx, span := ws.tracing.tracer.Start(ctx, "Transform", trace.WithAttributes(attribute.Int("entities.in", len(ec.Entities))))
+	transformed, transformErr := TransformEntities(ctx, endpoint.service, ec)
+	if transformErr != nil {
+		span.RecordError(transformErr)
+		span.SetStatus(codes.Error, transformErr.Type().String())
+	}
+	if transformed != nil {
+		span.SetAttributes(attribute.Int("entities.out", len(transformed.Entities)))
+	}
+	span.End()
+
+	if ctxErr := ws.contextError(ctx, settings, endpoint.logger); ctxErr != nil {
+		return ctxErr
+	}
+	var failures []EntityFailure
+	if transformErr != nil {
+		var pf *partialFailureError
+		if !errors.As(transformErr, &pf) || settings.partialFailures == nil || transformed == nil {
+			endpoint.logger.Warn(transformErr.Error(), "error_type", transformErr.Type().String())
+			return transformErr.toHTTPError()
+		}
+		if rejected := settings.partialFailures.accept(c, len(ec.Entities), pf.failures); rejected != nil {
+			endpoint.logger.Warn(rejected.Error(), "error_type", rejected.Type().String())
+			return rejected.toHTTPError()
+		}
+		failures = pf.failures
+		settings.partialFailures.declareTrailers(c)
 	}
 
 	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
@@ -160,10 +537,86 @@ func (ws *transformWebService) transform(c echo.Context) error {
 
 	err = transformed.WriteEntityGraphJSON(c.Response().Writer)
 	if err != nil {
-		ws.logger.Warn(err.Error())
-		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("could not write the response: %s", err.Error()))
+		endpoint.logger.Warn(err.Error())
+		return Errorf(LayerErrorInternal, "could not write the response: %s", err.Error()).toHTTPError()
 	}
 	c.Response().Flush()
+	if failures != nil {
+		settings.partialFailures.writeTrailers(c, failures)
+	}
+
+	return nil
+}
+
+// transformStream parses the request body one entity at a time and writes the results of the
+// StreamingTransformService to the response as they are emitted.
+func (ws *transformWebService) transformStream(ctx context.Context, c echo.Context, endpoint *transformEndpoint, settings *webSettings, streamingService StreamingTransformService) error {
+	nsManager := egdm.NewNamespaceContext()
+	parser := egdm.NewEntityParser(nsManager)
+	parser.WithExpandURIs()
+
+	writer := newEntityStreamWriter(c.Response(), nsManager.GetNamespaceMappings)
+	seen := 0
+	if settings.partialFailures != nil {
+		settings.partialFailures.declareTrailers(c)
+	}
+
+	ctx, span := ws.tracing.tracer.Start(ctx, "StreamEntity")
+	defer func() {
+		span.SetAttributes(attribute.Int("entities.in", seen), attribute.Int("entities.out", writer.count))
+		span.End()
+	}()
+
+	var transformErr TransformError
+	var failures []EntityFailure
+	count := countEntities(settings.maxEntities)
+	err := parser.Parse(c.Request().Body, func(entity *egdm.Entity) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := count(); err != nil {
+			return err
+		}
+		seen++
+		transformErr = streamingService.StreamEntity(ctx, entity, writer.Write)
+		if transformErr != nil && settings.partialFailures != nil && ctx.Err() == nil {
+			// record the failure and carry on with the next entity
+			failures = append(failures, EntityFailure{Entity: entity, Err: transformErr})
+			transformErr = nil
+		}
+		return transformErr
+	}, writer.SetContinuationToken)
+
+	if ctxErr := ws.contextError(ctx, settings, endpoint.logger); ctxErr != nil {
+		return ctxErr
+	}
+	if transformErr != nil {
+		span.RecordError(transformErr)
+		span.SetStatus(codes.Error, transformErr.Type().String())
+		endpoint.logger.Warn(transformErr.Error(), "error_type", transformErr.Type().String(), "written", writer.count)
+		return transformErr.toHTTPError()
+	}
+	if err != nil {
+		endpoint.logger.Warn(err.Error(), "written", writer.count)
+		return ws.parseError(c, err)
+	}
+	if settings.partialFailures != nil {
+		// when entities have already been written, returning the error leaves the response truncated
+		// so that the caller fails the batch
+		if rejected := settings.partialFailures.accept(c, seen, failures); rejected != nil {
+			endpoint.logger.Warn(rejected.Error(), "error_type", rejected.Type().String(), "written", writer.count)
+			return rejected.toHTTPError()
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		endpoint.logger.Warn(err.Error())
+		return Errorf(LayerErrorInternal, "could not write the response: %s", err.Error()).toHTTPError()
+	}
+	if settings.partialFailures != nil {
+		settings.partialFailures.writeTrailers(c, failures)
+	}
 
 	return nil
 }
@@ -0,0 +1,536 @@
+package common_http_transform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/labstack/echo/v4"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+)
+
+type testTransform struct {
+	transform func(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError)
+}
+
+func (tt *testTransform) Stop(_ context.Context) error { return nil }
+
+func (tt *testTransform) Transform(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	return tt.transform(ec)
+}
+
+func (tt *testTransform) UpdateConfiguration(_ *Config) TransformError { return nil }
+
+const testEntities = `[
+	{"id": "@context", "namespaces": {"ex": "http://example.com/"}},
+	{"id": "ex:1", "props": {"ex:name": "John Smith"}},
+	{"id": "ex:2", "props": {"ex:name": "James Shadwell"}}
+]`
+
+func newTestWebService(t *testing.T, ts TransformService) *transformWebService {
+	t.Helper()
+	return newTestWebServiceWithConfig(t, `{"layer_config": {"service_name": "test", "log_level": "error"}}`, ts)
+}
+
+func newTestWebServiceWithConfig(t *testing.T, conf string, ts TransformService) *transformWebService {
+	t.Helper()
+	config, err := readConfig(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := newMetrics(config, NewLogger("test", "json", "error"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := NewLogger("test", "json", "error")
+	ws, err := newTransformService(config, logger, metrics, ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func postTransform(ws *transformWebService, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/transform", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	ws.e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestTransformErrorStatusMapping(t *testing.T) {
+	cases := map[LayerErrorType]int{
+		LayerErrorBadParameter:        http.StatusBadRequest,
+		LayerErrorInternal:            http.StatusInternalServerError,
+		LayerNotSupported:             http.StatusNotImplemented,
+		LayerErrorUpstreamTimeout:     http.StatusGatewayTimeout,
+		LayerErrorUpstreamUnavailable: http.StatusServiceUnavailable,
+		LayerErrorRateLimited:         http.StatusTooManyRequests,
+		LayerErrorUnauthorized:        http.StatusUnauthorized,
+		LayerErrorForbidden:           http.StatusForbidden,
+		LayerErrorPayloadTooLarge:     http.StatusRequestEntityTooLarge,
+	}
+	for errType, status := range cases {
+		ws := newTestWebService(t, &testTransform{transform: func(_ *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+			return nil, Errorf(errType, "failed with %s", errType)
+		}})
+		rec := postTransform(ws, testEntities, map[string]string{echo.HeaderXRequestID: "req-1"})
+
+		if rec.Code != status {
+			t.Errorf("%s: expected status %d, got %d", errType, status, rec.Code)
+		}
+		if ct := rec.Header().Get(echo.HeaderContentType); ct != mimeApplicationProblemJSON {
+			t.Errorf("%s: expected content type %s, got %s", errType, mimeApplicationProblemJSON, ct)
+		}
+		p := &problem{}
+		if err := json.Unmarshal(rec.Body.Bytes(), p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Type != errType.String() || p.Status != status || p.RequestID != "req-1" {
+			t.Errorf("%s: unexpected problem body %+v", errType, p)
+		}
+		if p.Detail != "failed with "+errType.String() {
+			t.Errorf("%s: unexpected problem detail %s", errType, p.Detail)
+		}
+	}
+}
+
+func TestToProblemUnwrapsErrors(t *testing.T) {
+	cases := map[string]error{
+		"transform error": fmt.Errorf("calling upstream: %w", Errorf(LayerErrorRateLimited, "slow down")),
+		"http error":      fmt.Errorf("routing: %w", echo.NewHTTPError(http.StatusNotFound, "not found")),
+	}
+	expected := map[string]int{"transform error": http.StatusTooManyRequests, "http error": http.StatusNotFound}
+	for name, err := range cases {
+		if p := toProblem(err); p.Status != expected[name] {
+			t.Errorf("%s: expected status %d, got %d", name, expected[name], p.Status)
+		}
+	}
+}
+
+func TestTransformBadRequestBody(t *testing.T) {
+	ws := newTestWebService(t, &testTransform{transform: func(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+		return ec, nil
+	}})
+	rec := postTransform(ws, `{"not": "an array"}`, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", rec.Code)
+	}
+	p := &problem{}
+	if err := json.Unmarshal(rec.Body.Bytes(), p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Type != LayerErrorBadParameter.String() {
+		t.Errorf("expected problem type %s, got %s", LayerErrorBadParameter, p.Type)
+	}
+	if p.RequestID == "" {
+		t.Error("expected generated request id in problem body")
+	}
+}
+
+type testStreamingTransform struct {
+	testTransform
+	seen int
+}
+
+func (tt *testStreamingTransform) StreamEntity(_ context.Context, entity *egdm.Entity, emit func(entity *egdm.Entity) error) TransformError {
+	tt.seen++
+	if entity.ID == "http://example.com/1" {
+		// drop first entity, duplicate the rest
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		if err := emit(entity); err != nil {
+			return Err(err, LayerErrorInternal)
+		}
+	}
+	return nil
+}
+
+func TestTransformPrefersStreamingService(t *testing.T) {
+	ts := &testStreamingTransform{testTransform: testTransform{transform: func(_ *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+		return nil, Errorf(LayerErrorInternal, "Transform must not be called on a streaming service")
+	}}}
+	ws := newTestWebService(t, ts)
+	rec := postTransform(ws, testEntities, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ts.seen != 2 {
+		t.Errorf("expected 2 entities streamed, got %d", ts.seen)
+	}
+
+	parser := egdm.NewEntityParser(egdm.NewNamespaceContext()).WithExpandURIs()
+	ec, err := parser.LoadEntityCollection(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ec.Entities) != 2 {
+		t.Fatalf("expected 2 entities in response, got %d", len(ec.Entities))
+	}
+	if ec.Entities[0].ID != "http://example.com/2" || ec.Entities[1].ID != "http://example.com/2" {
+		t.Errorf("unexpected entities in response: %s, %s", ec.Entities[0].ID, ec.Entities[1].ID)
+	}
+	if ec.GetNamespaceMappings()["ex"] != "http://example.com/" {
+		t.Errorf("expected input namespaces in response context, got %v", ec.GetNamespaceMappings())
+	}
+}
+
+func TestTransformStreamKeepsContinuation(t *testing.T) {
+	ws := newTestWebService(t, &testStreamingTransform{})
+	body := strings.TrimSuffix(testEntities, "\n]") + `,
+	{"id": "@continuation", "token": "next-page"}
+]`
+	rec := postTransform(ws, body, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	ec, err := egdm.NewEntityParser(egdm.NewNamespaceContext()).WithExpandURIs().LoadEntityCollection(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ec.Continuation == nil || ec.Continuation.Token != "next-page" {
+		t.Errorf("expected the continuation of the request in the response, got %v", ec.Continuation)
+	}
+	if len(ec.Entities) != 2 {
+		t.Errorf("expected 2 entities in response, got %d", len(ec.Entities))
+	}
+}
+
+func TestTransformStreamErrorBeforeFirstEntity(t *testing.T) {
+	ws := newTestWebService(t, &testStreamingTransform{})
+	rec := postTransform(ws, `[{"id": "@context", "namespaces": {}}, 5]`, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", rec.Code)
+	}
+}
+
+type testContextTransform struct {
+	testTransform
+}
+
+func (tt *testContextTransform) Transform(ctx context.Context, _ *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	<-ctx.Done()
+	return nil, Err(ctx.Err(), LayerErrorInternal)
+}
+
+func TestTransformContextDeadline(t *testing.T) {
+	ws := newTestWebService(t, ContextTransform(&testContextTransform{}))
+	ws.settings.Store(&webSettings{transformTimeout: 10 * time.Millisecond})
+
+	rec := postTransform(ws, testEntities, nil)
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected status 504, got %d", rec.Code)
+	}
+	p := &problem{}
+	if err := json.Unmarshal(rec.Body.Bytes(), p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Type != LayerErrorUpstreamTimeout.String() {
+		t.Errorf("expected problem type %s, got %s", LayerErrorUpstreamTimeout, p.Type)
+	}
+}
+
+// disconnectTransform cancels the request when it is called, and returns its input once its context is done
+type disconnectTransform struct {
+	testTransform
+	disconnect context.CancelFunc
+	ctxErr     error
+}
+
+func (dt *disconnectTransform) Transform(ctx context.Context, ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	dt.disconnect()
+	<-ctx.Done()
+	dt.ctxErr = ctx.Err()
+	return ec, nil
+}
+
+func TestTransformClientDisconnect(t *testing.T) {
+	reqCtx, disconnect := context.WithCancel(context.Background())
+	defer disconnect()
+	dt := &disconnectTransform{disconnect: disconnect}
+	ws := newTestWebService(t, ContextTransform(dt))
+
+	req := httptest.NewRequest(http.MethodPost, "/transform", strings.NewReader(testEntities)).WithContext(reqCtx)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	ws.e.ServeHTTP(rec, req)
+
+	if dt.ctxErr != context.Canceled {
+		t.Errorf("expected the context of the transform to be cancelled, got %v", dt.ctxErr)
+	}
+	if rec.Code != statusClientClosedRequest {
+		t.Errorf("expected status 499, got %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "example.com") || strings.Contains(rec.Body.String(), "@context") {
+		t.Errorf("expected no entities to be written after the client disconnected, got %s", rec.Body.String())
+	}
+}
+
+func TestTransformTimeoutConfig(t *testing.T) {
+	config, _ := readConfig(strings.NewReader(`{"layer_config": {"transform_timeout": "30s"}}`))
+	ws, err := newTransformService(config, NewLogger("test", "json", "error"), &StatsdMetrics{client: &statsd.NoOpClient{}}, &testTransform{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.settings.Load().transformTimeout != 30*time.Second {
+		t.Errorf("expected transform timeout of 30s, got %s", ws.settings.Load().transformTimeout)
+	}
+
+	config, _ = readConfig(strings.NewReader(`{"layer_config": {"transform_timeout": "soon"}}`))
+	_, err = newTransformService(config, NewLogger("test", "json", "error"), &StatsdMetrics{client: &statsd.NoOpClient{}}, &testTransform{})
+	if err == nil {
+		t.Error("expected invalid transform_timeout to be rejected")
+	}
+}
+
+func TestTransformPartialFailure(t *testing.T) {
+	deadLetterFile := filepath.Join(t.TempDir(), "dead_letters.jsonl")
+	conf := fmt.Sprintf(`{"layer_config": {"partial_failure_enabled": true, "max_failure_ratio": 0.5, "dead_letter_file": %q}}`, deadLetterFile)
+	failing := NewEntityTransformService(funcEntityTransformer(func(_ context.Context, entity *egdm.Entity) ([]*egdm.Entity, error) {
+		if entity.ID == "http://example.com/1" {
+			return nil, Errorf(LayerErrorUpstreamUnavailable, "lookup failed")
+		}
+		return []*egdm.Entity{entity}, nil
+	})).WithErrorMode(CollectAllErrors)
+
+	ws := newTestWebServiceWithConfig(t, conf, failing)
+	rec := postTransform(ws, testEntities, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	parser := egdm.NewEntityParser(egdm.NewNamespaceContext()).WithExpandURIs()
+	ec, err := parser.LoadEntityCollection(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ec.Entities) != 1 || ec.Entities[0].ID != "http://example.com/2" {
+		t.Errorf("expected only the successful entity in response, got %d entities", len(ec.Entities))
+	}
+	trailer := rec.Result().Trailer
+	if trailer.Get(HeaderFailedEntityCount) != "1" {
+		t.Errorf("expected failed count trailer to be 1, got %q", trailer.Get(HeaderFailedEntityCount))
+	}
+	if !strings.Contains(trailer.Get(HeaderFailedEntities), "http://example.com/1") {
+		t.Errorf("expected failed entity in trailer, got %q", trailer.Get(HeaderFailedEntities))
+	}
+	deadLetters, err := os.ReadFile(deadLetterFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(deadLetters), "lookup failed") {
+		t.Errorf("expected failure in dead letter file, got %s", deadLetters)
+	}
+
+	// every entity failing exceeds the max failure ratio
+	conf = `{"layer_config": {"partial_failure_enabled": true, "max_failure_ratio": 0.5}}`
+	failing = NewEntityTransformService(funcEntityTransformer(func(_ context.Context, entity *egdm.Entity) ([]*egdm.Entity, error) {
+		return nil, Errorf(LayerErrorUpstreamUnavailable, "lookup failed")
+	})).WithErrorMode(CollectAllErrors)
+	ws = newTestWebServiceWithConfig(t, conf, failing)
+	rec = postTransform(ws, testEntities, nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", rec.Code)
+	}
+
+	// a wrapped partial failure is still recognised
+	wrapping := &testTransform{transform: func(ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+		result := egdm.NewEntityCollection(ec.NamespaceManager)
+		_ = result.AddEntity(ec.Entities[1])
+		pf := PartialFailure(EntityFailure{Entity: ec.Entities[0], Err: errors.New("lookup failed")})
+		return result, Err(fmt.Errorf("enrich: %w", pf), pf.Type())
+	}}
+	ws = newTestWebServiceWithConfig(t, conf, wrapping)
+	rec = postTransform(ws, testEntities, nil)
+	if rec.Code != http.StatusOK || rec.Result().Trailer.Get(HeaderFailedEntityCount) != "1" {
+		t.Errorf("expected the wrapped partial failure to return the partial result, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestTransformPartialFailureMetrics(t *testing.T) {
+	config, err := readConfig(strings.NewReader(`{"layer_config": {"partial_failure_enabled": true, "max_failure_ratio": 1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := NewEntityTransformService(funcEntityTransformer(func(_ context.Context, _ *egdm.Entity) ([]*egdm.Entity, error) {
+		return nil, Errorf(LayerErrorUpstreamUnavailable, "lookup failed")
+	})).WithErrorMode(CollectAllErrors)
+	metrics := &countingMetrics{counts: map[string]int{}, gauges: map[string]float64{}}
+	ws, err := newTransformService(config, NewLogger("test", "json", "error"), metrics, failing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := postTransform(ws, testEntities, nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if metrics.gauges["transform.entity.failed url:/transform"] != 2 {
+		t.Errorf("expected the failures of the batch to be reported once, got %v", metrics.gauges)
+	}
+	if metrics.counts["transform.entity.failed url:/transform"] != 0 {
+		t.Errorf("expected no per entity failure count, got %v", metrics.counts)
+	}
+}
+
+func TestPartialFailurePolicyMaxFailureRatio(t *testing.T) {
+	for name, tc := range map[string]struct {
+		conf  string
+		ratio float64
+	}{
+		"default":    {`{"layer_config": {"partial_failure_enabled": true}}`, defaultMaxFailureRatio},
+		"zero":       {`{"layer_config": {"partial_failure_enabled": true, "max_failure_ratio": 0}}`, 0},
+		"no limit":   {`{"layer_config": {"partial_failure_enabled": true, "max_failure_ratio": 1}}`, 1},
+		"configured": {`{"layer_config": {"partial_failure_enabled": true, "max_failure_ratio": 0.25}}`, 0.25},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config, err := readConfig(strings.NewReader(tc.conf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			policy, err := newPartialFailurePolicy(config.LayerServiceConfig, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if policy.maxFailureRatio != tc.ratio {
+				t.Errorf("expected max failure ratio %v, got %v", tc.ratio, policy.maxFailureRatio)
+			}
+		})
+	}
+
+	config, _ := readConfig(strings.NewReader(`{"layer_config": {"partial_failure_enabled": true, "max_failure_ratio": 1.5}}`))
+	if _, err := newPartialFailurePolicy(config.LayerServiceConfig, nil, nil); err == nil {
+		t.Error("expected max_failure_ratio above 1 to be rejected")
+	}
+}
+
+func TestWebServiceUpdateConfiguration(t *testing.T) {
+	ws := newTestWebService(t, &testTransform{})
+
+	config, _ := readConfig(strings.NewReader(`{"layer_config": {"service_name": "test", "transform_timeout": "2s"}}`))
+	if err := ws.ValidateConfiguration(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.UpdateConfiguration(config); err != nil {
+		t.Fatal(err)
+	}
+	if ws.settings.Load().transformTimeout != 2*time.Second {
+		t.Errorf("expected transform timeout of 2s after update, got %s", ws.settings.Load().transformTimeout)
+	}
+
+	config, _ = readConfig(strings.NewReader(`{"layer_config": {"service_name": "test", "transform_timeout": "soon"}}`))
+	if err := ws.ValidateConfiguration(config); err == nil {
+		t.Error("expected invalid transform_timeout to be rejected")
+	}
+	if ws.settings.Load().transformTimeout != 2*time.Second {
+		t.Errorf("expected rejected config to leave transform timeout unchanged, got %s", ws.settings.Load().transformTimeout)
+	}
+}
+
+type blockingTransform struct {
+	testTransform
+	started chan struct{}
+	release chan struct{}
+}
+
+func (bt *blockingTransform) Transform(ctx context.Context, ec *egdm.EntityCollection) (*egdm.EntityCollection, TransformError) {
+	close(bt.started)
+	select {
+	case <-bt.release:
+		return ec, nil
+	case <-ctx.Done():
+		return nil, Err(ctx.Err(), LayerErrorInternal)
+	}
+}
+
+func startBlockingTransform(t *testing.T, conf string) (*transformWebService, *blockingTransform, chan error) {
+	t.Helper()
+	bt := &blockingTransform{started: make(chan struct{}), release: make(chan struct{})}
+	ws := newTestWebServiceWithConfig(t, conf, ContextTransform(bt))
+	if err := ws.Start(); err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + ws.e.Listener.Addr().String() + "/transform"
+	result := make(chan error, 1)
+	go func() {
+		resp, err := http.Post(url, echo.MIMEApplicationJSON, strings.NewReader(testEntities))
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("status %d", resp.StatusCode)
+			}
+		}
+		result <- err
+	}()
+	<-bt.started
+	return ws, bt, result
+}
+
+func TestWebServiceStopDrainsInFlightTransforms(t *testing.T) {
+	ws, bt, result := startBlockingTransform(t, `{"layer_config": {"log_level": "error", "port": "0"}}`)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(bt.release)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ws.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("expected in-flight transform to complete, got %v", err)
+	}
+}
+
+func TestWebServiceStopTerminatesStragglers(t *testing.T) {
+	ws, _, result := startBlockingTransform(t, `{"layer_config": {"log_level": "error", "port": "0"}}`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := ws.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("expected straggling transform to be terminated")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected straggling transform to be terminated")
+	}
+}
+
+func TestWebServiceDrainDelayDoesNotUseUpShutdownTimeout(t *testing.T) {
+	ws, bt, result := startBlockingTransform(t, `{"layer_config": {"log_level": "error", "port": "0", "shutdown_drain_delay": "1s"}}`)
+
+	go func() {
+		// completes after the drain delay, within the shutdown timeout that follows it
+		time.Sleep(1500 * time.Millisecond)
+		close(bt.release)
+	}()
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ws.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("expected in-flight transform to complete after the drain delay, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected Stop to wait for the drain delay, returned after %s", elapsed)
+	}
+}